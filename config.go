@@ -8,6 +8,7 @@ import (
 	"github.com/c3b2a7/goproxy/services"
 	"github.com/c3b2a7/goproxy/utils"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"net"
 	"os"
 	"strings"
 )
@@ -24,6 +25,7 @@ func initConfig() (err error) {
 	//define  args
 	tcpArgs := services.TCPArgs{}
 	httpArgs := services.HTTPArgs{}
+	socksArgs := services.SOCKSArgs{}
 	tunnelServerArgs := services.TunnelServerArgs{}
 	tunnelClientArgs := services.TunnelClientArgs{}
 	tunnelBridgeArgs := services.TunnelBridgeArgs{}
@@ -37,43 +39,135 @@ func initConfig() (err error) {
 	forever := app.Flag("forever", "run in forever").Default("false").Bool()
 	doNotUpdate := app.Flag("do-not-update", "do not automatic update").Bool()
 
-	args.Parent = app.Flag("parent", "parent address, such as: \"23.32.32.19:28008\"").Default("").Short('P').String()
+	args.Parent = app.Flag("parent", "parent address, several parents are separated by comma with an optional #weight, such as: \"23.32.32.19:28008\" or \"23.32.32.19:28008#2,23.32.32.20:28008\"").Default("").Short('P').String()
 	args.Local = app.Flag("local", "local ip:port to listen").Short('p').Default(":33080").String()
 	certTLS := app.Flag("cert", "cert file for tls").Short('C').Default("").String()
 	keyTLS := app.Flag("key", "key file for tls").Short('K').Default("").String()
+	allowFile := app.Flag("allow-file", "only accept clients whose ip is in file, an ip or CIDR each line").Default("").String()
+	denyFile := app.Flag("deny-file", "reject clients whose ip is in file, an ip or CIDR each line").Default("").String()
+	maxUpload := app.Flag("max-upload", "upload bytes per second of the whole service, from clients to targets, K, M and G suffixes are allowed, zero means no limit").Default("0").String()
+	maxDownload := app.Flag("max-download", "download bytes per second of the whole service, from targets to clients, K, M and G suffixes are allowed, zero means no limit").Default("0").String()
+	maxConnsPerIP := app.Flag("max-conns-per-ip", "concurrent conns of a client ip, zero means no limit").Default("0").Int()
+	connRatePerIP := app.Flag("conn-rate-per-ip", "new conns per second of a client ip, zero means no limit").Default("0").Float64()
+	ipFilterInterval := app.Flag("ip-filter-interval", "reload --allow-file and --deny-file when changed, check every interval seconds, zero means no reload").Default("5").Int()
 
 	//########http#########
 	http := app.Command("http", "proxy on http mode")
 	httpArgs.LocalType = http.Flag("local-type", "local protocol type <tls|tcp>").Default("tcp").Short('t').Enum("tls", "tcp")
-	httpArgs.ParentType = http.Flag("parent-type", "parent protocol type <tls|tcp>").Short('T').Enum("tls", "tcp")
+	httpArgs.ParentType = http.Flag("parent-type", "parent protocol type <tls|tcp|http|https|socks5>, http and https are standard http proxies asked with CONNECT, socks5 is a standard socks5 server").Short('T').Enum("tls", "tcp", "http", "https", "socks5")
+	httpArgs.LBMethod = http.Flag("lb-method", "how to select one of several parents <round-robin|least-conn|latency|hash>, hash keeps a client ip on one parent").Default(utils.LBRoundRobin).Enum(utils.LBRoundRobin, utils.LBLeastConn, utils.LBLatency, utils.LBHash)
+	httpArgs.ParentAuth = http.Flag("parent-auth", "username and password of a http, https or socks5 parent, such as: user:pass").Default("").String()
 	httpArgs.Always = http.Flag("always", "always use parent proxy").Default("false").Bool()
 	httpArgs.Timeout = http.Flag("timeout", "tcp timeout milliseconds when connect to real server or parent proxy").Default("2000").Int()
 	httpArgs.HTTPTimeout = http.Flag("http-timeout", "check domain if blocked , http request timeout milliseconds when connect to host").Default("3000").Int()
 	httpArgs.Interval = http.Flag("interval", "check domain if blocked every interval seconds").Default("10").Int()
-	httpArgs.Blocked = http.Flag("blocked", "blocked domain file , one domain each line").Default("blocked").Short('b').String()
-	httpArgs.Direct = http.Flag("direct", "direct domain file , one domain each line").Default("direct").Short('d').String()
-	httpArgs.AuthFile = http.Flag("auth-file", "http basic auth file,\"username:password\" each line in file").Short('F').String()
+	httpArgs.Blocked = http.Flag("blocked", "blocked domain file or http(s) url, one domain each line with optional * and ? wildcards, /regexp/, or AdBlock Plus rules such as gfwlist, base64 encoded or not").Default("blocked").Short('b').String()
+	httpArgs.Direct = http.Flag("direct", "direct domain file or http(s) url, one domain each line with optional * and ? wildcards, /regexp/, or AdBlock Plus rules, base64 encoded or not").Default("direct").Short('d').String()
+	httpArgs.ListRefresh = http.Flag("list-refresh", "fetch --blocked and --direct urls again every interval seconds").Default("86400").Int()
+	httpArgs.ListCacheDir = http.Flag("list-cache-dir", "directory of the local copies of --blocked and --direct urls, used until the urls are fetched again").Default(".").String()
+	httpArgs.CheckerStateFile = http.Flag("checker-state-file", "file the blocked check results are saved to and loaded from at start, several instances may share it").Default("").String()
+	httpArgs.CheckerStateInterval = http.Flag("checker-state-interval", "save --checker-state-file every interval seconds").Default("60").Int()
+	httpArgs.CheckerStateMaxAge = http.Flag("checker-state-max-age", "drop check results of hosts not checked for so many seconds").Default("604800").Int()
+	httpArgs.CheckerMaxHosts = http.Flag("checker-max-hosts", "number of hosts the blocked check keeps, the least recently used are dropped, 0 means no limit").Default("10000").Int()
+	httpArgs.CheckerTTL = http.Flag("checker-ttl", "drop hosts not requested for so many seconds from the blocked check, 0 means never").Default("86400").Int()
+	httpArgs.CheckerHalfLife = http.Flag("checker-half-life", "halve the check counts of a host every so many seconds, so it is checked again, 0 means never").Default("21600").Int()
+	httpArgs.CheckerProbes = http.Flag("checker-probes", "number of blocked checks run at once, 0 means no limit").Default("16").Int()
+	httpArgs.AuthFile = http.Flag("auth-file", "http basic auth file in htpasswd format, \"username:password\" each line, password is a bcrypt, sha256/sha512 crypt or {SHA} hash, or plaintext").Short('F').String()
 	httpArgs.Auth = http.Flag("auth", "http basic auth username and password, multiple users repeat with -a, such as: -a user1:pass1 -a user2:pass2").Short('a').Strings()
-	httpArgs.PoolSize = http.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool").Short('L').Default("20").Int()
+	httpArgs.AuthURL = http.Flag("auth-url", "check credentials with a GET request to url carrying them in the Authorization header, 2xx means accepted, 401 and 403 mean rejected").Default("").String()
+	httpArgs.AuthCmd = http.Flag("auth-cmd", "check credentials by running a command, username and password are written to its stdin one per line, exit status 0 means accepted, 1 means rejected").Default("").String()
+	httpArgs.AuthTimeout = http.Flag("auth-timeout", "timeout milliseconds of --auth-url and --auth-cmd").Default("3000").Int()
+	httpArgs.AuthCache = http.Flag("auth-cache", "cache verdicts of --auth-url and --auth-cmd for seconds, zero means no cache").Default("60").Int()
+	httpArgs.AuthMaxFails = http.Flag("auth-max-fails", "ban a client ip or a username after failing auth so many times within --auth-fail-window, zero means no ban").Default("10").Int()
+	httpArgs.AuthFailWindow = http.Flag("auth-fail-window", "seconds in which auth failures are counted").Default("600").Int()
+	httpArgs.AuthBanTime = http.Flag("auth-ban-time", "seconds of the first ban, doubled with every ban in a row").Default("60").Int()
+	httpArgs.AuthMaxBanTime = http.Flag("auth-max-ban-time", "seconds of the longest ban").Default("3600").Int()
+	httpArgs.AuthBanFile = http.Flag("auth-ban-file", "file the current bans are written to, remove a line to lift a ban, it is read at start so bans survive restarts").Default("").String()
+	httpArgs.UserLimit = http.Flag("user-limit", "upload and download bytes per second of a user, shared by all its conns, K, M and G suffixes are allowed, zero means no limit, user * applies to users without their own, multiple users repeat with --user-limit, such as: --user-limit user1:512K:2M --user-limit *:1M:1M").Strings()
+	httpArgs.UserLimitFile = http.Flag("user-limit-file", "user limit file, \"user upload download\" each line, reloaded when changed, --user-limit takes precedence").Default("").String()
+	httpArgs.UserLimitInterval = http.Flag("user-limit-interval", "check --user-limit-file for changes every interval seconds, zero means no reload").Default("5").Int()
+	httpArgs.MaxConnsPerUser = http.Flag("max-conns-per-user", "concurrent conns of a user, zero means no limit").Default("0").Int()
+	httpArgs.ConnRatePerUser = http.Flag("conn-rate-per-user", "new conns and requests per second of a user, zero means no limit").Default("0").Float64()
+	httpArgs.PoolSize = http.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool, http and socks5 parents are not pooled").Short('L').Default("20").Int()
 	httpArgs.CheckParentInterval = http.Flag("check-parent-interval", "check if proxy is okay every interval seconds, zero means no check").Short('I').Default("3").Int()
 	httpArgs.MagicHeader = http.Flag("magic-header", "used to determine which iface to use to connect to target").Short('h').Default("").String()
 	httpArgs.MappingFile = http.Flag("mapping-file", "used to mapping external IP to internal IP in nat environment").Short('m').Default("").String()
 	httpArgs.AutoMapping = http.Flag("auto-mapping", "mapping external IP to internal IP automatically").Short('M').Default("false").Bool()
 	httpArgs.CheckMappingInterval = http.Flag("check-mapping-interval", "monitor internal IP and update mapping every interval seconds, zero means no check").Short('c').Default("30").Int()
+	httpArgs.MaxHeaderSize = http.Flag("max-header-size", "max size in bytes of a request head, larger requests are answered with 431").Default("8192").Int()
+	httpArgs.HeaderTimeout = http.Flag("header-timeout", "milliseconds allowed to receive a whole request head, also limits idle keep-alive conns, zero means no limit").Default("30000").Int()
+	httpArgs.ACLFile = http.Flag("acl-file", "per-user destination policy file, lines of \"group <name> <user>...\" and \"allow|deny <user|@group|*> <destination> [ports]\", first matching rule wins, unmatched destinations are denied").Default("").String()
+	httpArgs.Rules = http.Flag("rules", "ordered rules file routing requests to direct, reject, parent, parent:<name> or outbound:<name>, lines of \"<matcher>... <action>\", matchers are domain:, suffix:, keyword:, regex:, cidr:, port:, src:, user:, geoip:, asn: and *, first matching rule wins, unmatched requests are routed by --blocked and --direct").Default("").String()
+	httpArgs.RulesInterval = http.Flag("rules-interval", "check --rules for changes every interval seconds, zero means no reload").Default("5").Int()
+	httpArgs.GeoIPDB = http.Flag("geoip-db", "MaxMind country, city or asn database in mmdb format for --geoip-direct and the geoip: and asn: matchers of --rules, multiple databases repeat with --geoip-db").Strings()
+	httpArgs.GeoIPInterval = http.Flag("geoip-interval", "check --geoip-db for changes every interval seconds, zero means no reload").Default("5").Int()
+	httpArgs.GeoIPDirect = http.Flag("geoip-direct", "comma separated ISO country codes, such as CN,HK, destinations in them go direct and others to the parent, unless they are in --blocked or --direct").Default("").String()
+	httpArgs.Race = http.Flag("race", "connect directly and through the parent at once to hosts the blocked check has not classified, the first to connect is used and the faster path is kept for the next requests").Default("false").Bool()
+	httpArgs.RaceDelay = http.Flag("race-delay", "milliseconds the direct connect of --race starts before the parent one").Default("100").Int()
 	httpArgs.IPResolver = http.Flag("ip-resolver", "ip resolver api, multiple apis repeat with -r, such as: -r ip.sb -r ipinfo.io, available: <"+strings.Join(utils.AvailableIPRResolvers(), "|")+">").Default(utils.AvailableIPRResolvers()...).PlaceHolder("ALL").Short('r').Enums(utils.AvailableIPRResolvers()...)
 
+	//########socks#########
+	socks := app.Command("socks", "proxy on socks5 mode")
+	socksArgs.LocalType = socks.Flag("local-type", "local protocol type <tls|tcp>").Default("tcp").Short('t').Enum("tls", "tcp")
+	socksArgs.ParentType = socks.Flag("parent-type", "parent protocol type <tls|tcp>").Short('T').Enum("tls", "tcp")
+	socksArgs.ParentAuth = socks.Flag("parent-auth", "username and password of the socks5 parent, such as: user:pass").Default("").String()
+	socksArgs.LBMethod = socks.Flag("lb-method", "how to select one of several parents <round-robin|least-conn|latency|hash>, hash keeps a client ip on one parent").Default(utils.LBRoundRobin).Enum(utils.LBRoundRobin, utils.LBLeastConn, utils.LBLatency, utils.LBHash)
+	socksArgs.Always = socks.Flag("always", "always use parent proxy").Default("false").Bool()
+	socksArgs.Timeout = socks.Flag("timeout", "tcp timeout milliseconds when connect to real server or parent proxy").Default("2000").Int()
+	socksArgs.HTTPTimeout = socks.Flag("http-timeout", "check domain if blocked , http request timeout milliseconds when connect to host").Default("3000").Int()
+	socksArgs.Interval = socks.Flag("interval", "check domain if blocked every interval seconds").Default("10").Int()
+	socksArgs.Blocked = socks.Flag("blocked", "blocked domain file or http(s) url, one domain each line with optional * and ? wildcards, /regexp/, or AdBlock Plus rules such as gfwlist, base64 encoded or not").Default("blocked").Short('b').String()
+	socksArgs.Direct = socks.Flag("direct", "direct domain file or http(s) url, one domain each line with optional * and ? wildcards, /regexp/, or AdBlock Plus rules, base64 encoded or not").Default("direct").Short('d').String()
+	socksArgs.ListRefresh = socks.Flag("list-refresh", "fetch --blocked and --direct urls again every interval seconds").Default("86400").Int()
+	socksArgs.ListCacheDir = socks.Flag("list-cache-dir", "directory of the local copies of --blocked and --direct urls, used until the urls are fetched again").Default(".").String()
+	socksArgs.CheckerStateFile = socks.Flag("checker-state-file", "file the blocked check results are saved to and loaded from at start, several instances may share it").Default("").String()
+	socksArgs.CheckerStateInterval = socks.Flag("checker-state-interval", "save --checker-state-file every interval seconds").Default("60").Int()
+	socksArgs.CheckerStateMaxAge = socks.Flag("checker-state-max-age", "drop check results of hosts not checked for so many seconds").Default("604800").Int()
+	socksArgs.CheckerMaxHosts = socks.Flag("checker-max-hosts", "number of hosts the blocked check keeps, the least recently used are dropped, 0 means no limit").Default("10000").Int()
+	socksArgs.CheckerTTL = socks.Flag("checker-ttl", "drop hosts not requested for so many seconds from the blocked check, 0 means never").Default("86400").Int()
+	socksArgs.CheckerHalfLife = socks.Flag("checker-half-life", "halve the check counts of a host every so many seconds, so it is checked again, 0 means never").Default("21600").Int()
+	socksArgs.CheckerProbes = socks.Flag("checker-probes", "number of blocked checks run at once, 0 means no limit").Default("16").Int()
+	socksArgs.AuthFile = socks.Flag("auth-file", "socks5 auth file in htpasswd format, \"username:password\" each line, password is a bcrypt, sha256/sha512 crypt or {SHA} hash, or plaintext").Short('F').String()
+	socksArgs.Auth = socks.Flag("auth", "socks5 auth username and password, multiple users repeat with -a, such as: -a user1:pass1 -a user2:pass2").Short('a').Strings()
+	socksArgs.AuthURL = socks.Flag("auth-url", "check credentials with a GET request to url carrying them in the Authorization header, 2xx means accepted, 401 and 403 mean rejected").Default("").String()
+	socksArgs.AuthCmd = socks.Flag("auth-cmd", "check credentials by running a command, username and password are written to its stdin one per line, exit status 0 means accepted, 1 means rejected").Default("").String()
+	socksArgs.AuthTimeout = socks.Flag("auth-timeout", "timeout milliseconds of --auth-url and --auth-cmd").Default("3000").Int()
+	socksArgs.AuthCache = socks.Flag("auth-cache", "cache verdicts of --auth-url and --auth-cmd for seconds, zero means no cache").Default("60").Int()
+	socksArgs.AuthMaxFails = socks.Flag("auth-max-fails", "ban a client ip or a username after failing auth so many times within --auth-fail-window, zero means no ban").Default("10").Int()
+	socksArgs.AuthFailWindow = socks.Flag("auth-fail-window", "seconds in which auth failures are counted").Default("600").Int()
+	socksArgs.AuthBanTime = socks.Flag("auth-ban-time", "seconds of the first ban, doubled with every ban in a row").Default("60").Int()
+	socksArgs.AuthMaxBanTime = socks.Flag("auth-max-ban-time", "seconds of the longest ban").Default("3600").Int()
+	socksArgs.AuthBanFile = socks.Flag("auth-ban-file", "file the current bans are written to, remove a line to lift a ban, it is read at start so bans survive restarts").Default("").String()
+	socksArgs.UserLimit = socks.Flag("user-limit", "upload and download bytes per second of a user, shared by all its conns, K, M and G suffixes are allowed, zero means no limit, user * applies to users without their own, multiple users repeat with --user-limit, such as: --user-limit user1:512K:2M --user-limit *:1M:1M").Strings()
+	socksArgs.UserLimitFile = socks.Flag("user-limit-file", "user limit file, \"user upload download\" each line, reloaded when changed, --user-limit takes precedence").Default("").String()
+	socksArgs.UserLimitInterval = socks.Flag("user-limit-interval", "check --user-limit-file for changes every interval seconds, zero means no reload").Default("5").Int()
+	socksArgs.MaxConnsPerUser = socks.Flag("max-conns-per-user", "concurrent conns of a user, zero means no limit").Default("0").Int()
+	socksArgs.ConnRatePerUser = socks.Flag("conn-rate-per-user", "new conns per second of a user, zero means no limit").Default("0").Float64()
+	socksArgs.PoolSize = socks.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool").Short('L').Default("20").Int()
+	socksArgs.CheckParentInterval = socks.Flag("check-parent-interval", "check if proxy is okay every interval seconds, zero means no check").Short('I').Default("3").Int()
+	socksArgs.UDPTimeout = socks.Flag("udp-timeout", "udp associate idle timeout seconds, also for each remote peer of an association").Default("60").Int()
+	socksArgs.MagicUser = socks.Flag("magic-user", "username carries the outbound used to determine which iface to use, such as: user@47.168.24.100").Short('h').Default("false").Bool()
+	socksArgs.MappingFile = socks.Flag("mapping-file", "used to mapping external IP to internal IP in nat environment").Short('m').Default("").String()
+	socksArgs.AutoMapping = socks.Flag("auto-mapping", "mapping external IP to internal IP automatically").Short('M').Default("false").Bool()
+	socksArgs.CheckMappingInterval = socks.Flag("check-mapping-interval", "monitor internal IP and update mapping every interval seconds, zero means no check").Short('c').Default("30").Int()
+	socksArgs.IPResolver = socks.Flag("ip-resolver", "ip resolver api, multiple apis repeat with -r, such as: -r ip.sb -r ipinfo.io, available: <"+strings.Join(utils.AvailableIPRResolvers(), "|")+">").Default(utils.AvailableIPRResolvers()...).PlaceHolder("ALL").Short('r').Enums(utils.AvailableIPRResolvers()...)
+
 	//########tcp#########
 	tcp := app.Command("tcp", "proxy on tcp mode")
 	tcpArgs.Timeout = tcp.Flag("timeout", "tcp timeout milliseconds when connect to real server or parent proxy").Short('t').Default("2000").Int()
-	tcpArgs.ParentType = tcp.Flag("parent-type", "parent protocol type <tls|tcp|udp>").Short('T').Enum("tls", "tcp", "udp")
+	tcpArgs.ParentType = tcp.Flag("parent-type", "parent protocol type <tls|tcp|udp|http|https|socks5>, http and https are standard http proxies asked with CONNECT to --target, socks5 is a standard socks5 server asked to connect to --target").Short('T').Enum("tls", "tcp", "udp", "http", "https", "socks5")
+	tcpArgs.LBMethod = tcp.Flag("lb-method", "how to select one of several parents <round-robin|least-conn|latency|hash>, hash keeps a client ip on one parent").Default(utils.LBRoundRobin).Enum(utils.LBRoundRobin, utils.LBLeastConn, utils.LBLatency, utils.LBHash)
+	tcpArgs.ParentAuth = tcp.Flag("parent-auth", "username and password of a http, https or socks5 parent, such as: user:pass").Default("").String()
+	tcpArgs.Target = tcp.Flag("target", "address the http, https or socks5 parent connects to, such as: \"example.com:22\"").Default("").String()
 	tcpArgs.IsTLS = tcp.Flag("tls", "proxy on tls mode").Default("false").Bool()
-	tcpArgs.PoolSize = tcp.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool").Short('L').Default("20").Int()
+	tcpArgs.PoolSize = tcp.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool, http and socks5 parents are not pooled").Short('L').Default("20").Int()
 	tcpArgs.CheckParentInterval = tcp.Flag("check-parent-interval", "check if proxy is okay every interval seconds, zero means no check").Short('I').Default("3").Int()
 
 	//########udp#########
 	udp := app.Command("udp", "proxy on udp mode")
 	udpArgs.Timeout = udp.Flag("timeout", "tcp timeout milliseconds when connect to parent proxy").Short('t').Default("2000").Int()
 	udpArgs.ParentType = udp.Flag("parent-type", "parent protocol type <tls|tcp|udp>").Short('T').Enum("tls", "tcp", "udp")
+	udpArgs.LBMethod = udp.Flag("lb-method", "how to select one of several parents <round-robin|least-conn|latency|hash>, hash keeps a client ip on one parent").Default(utils.LBRoundRobin).Enum(utils.LBRoundRobin, utils.LBLeastConn, utils.LBLatency, utils.LBHash)
 	udpArgs.PoolSize = udp.Flag("pool-size", "conn pool size , which connect to parent proxy, zero means turn off pool").Short('L').Default("20").Int()
 	udpArgs.CheckParentInterval = udp.Flag("check-parent-interval", "check if proxy is okay every interval seconds, zero means no check").Short('I').Default("3").Int()
 
@@ -93,7 +187,37 @@ func initConfig() (err error) {
 	tunnelBridge := app.Command("tbridge", "proxy on tunnel bridge mode")
 	tunnelBridgeArgs.Timeout = tunnelBridge.Flag("timeout", "tcp timeout with milliseconds").Short('t').Default("2000").Int()
 
+	//########passwd#########
+	passwd := app.Command("passwd", "create or update a user of a htpasswd file for --auth-file")
+	passwdFile := passwd.Arg("file", "htpasswd file, created if not exists").Required().String()
+	passwdUser := passwd.Arg("username", "username to add, update or delete").Required().String()
+	passwdAlgorithm := passwd.Flag("algorithm", "password hash algorithm <bcrypt|sha512|sha256|sha>").Default(utils.HashBcrypt).Short('A').Enum(utils.HashBcrypt, utils.HashSHA512, utils.HashSHA256, utils.HashSHA1)
+	passwdCost := passwd.Flag("cost", "bcrypt cost").Default("10").Int()
+	passwdDelete := passwd.Flag("delete", "delete the user").Short('D').Bool()
+
+	//########route#########
+	route := app.Command("route", "show which rule of a --rules file a request hits, without connecting")
+	routeFile := route.Arg("file", "rules file").Required().String()
+	routeAddress := route.Arg("address", "destination host:port, port 80 if omitted").Required().String()
+	routeSrc := route.Flag("src", "client ip").Default("").String()
+	routeUser := route.Flag("user", "authenticated user").Default("").String()
+	routeGeoIPDB := route.Flag("geoip-db", "mmdb database for geoip: and asn: matchers, multiple databases repeat with --geoip-db").Strings()
+
 	serviceName := kingpin.MustParse(app.Parse(os.Args[1:]))
+	if serviceName == passwd.FullCommand() {
+		if err = utils.Passwd(*passwdFile, *passwdUser, *passwdAlgorithm, *passwdCost, *passwdDelete); err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if serviceName == route.FullCommand() {
+		if err = dryRunRules(*routeFile, *routeAddress, *routeSrc, *routeUser, *routeGeoIPDB); err != nil {
+			fmt.Fprintf(os.Stderr, "[-] Error: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
 	return process.Start(*daemon, *forever, func() (err error) {
 		if *certTLS != "" && *keyTLS != "" {
@@ -102,9 +226,26 @@ func initConfig() (err error) {
 				return
 			}
 		}
+		if *allowFile != "" || *denyFile != "" {
+			args.IPFilter, err = utils.NewIPFilter(*allowFile, *denyFile, *ipFilterInterval)
+			if err != nil {
+				return
+			}
+		}
+
+		if *maxConnsPerIP > 0 || *connRatePerIP > 0 {
+			args.IPQuota = utils.NewQuota(*maxConnsPerIP, *connRatePerIP)
+		}
+		if args.Upload, err = serviceLimiters(*maxUpload); err != nil {
+			return fmt.Errorf("max-upload ERR:%s", err)
+		}
+		if args.Download, err = serviceLimiters(*maxDownload); err != nil {
+			return fmt.Errorf("max-download ERR:%s", err)
+		}
 
 		//common args
 		httpArgs.Args = args
+		socksArgs.Args = args
 		tcpArgs.Args = args
 		udpArgs.Args = args
 		tunnelBridgeArgs.Args = args
@@ -114,6 +255,7 @@ func initConfig() (err error) {
 		poster()
 		//register services and run service
 		services.Register("http", services.NewHTTP(), httpArgs)
+		services.Register("socks", services.NewSOCKS(), socksArgs)
 		services.Register("tcp", services.NewTCP(), tcpArgs)
 		services.Register("udp", services.NewUDP(), udpArgs)
 		services.Register("tserver", services.NewTunnelServer(), tunnelServerArgs)
@@ -149,6 +291,16 @@ func poster() {
 	Version: %s
 	Build on: %s`+"\n\n", Version, BuildTime)
 }
+
+// serviceLimiters returns the limiter shared by all conns of the service,
+// nil when there is no limit.
+func serviceLimiters(bytesPerSec string) (limiters utils.Limiters, err error) {
+	rate, err := utils.ParseRate(bytesPerSec)
+	if err != nil || rate == 0 {
+		return
+	}
+	return utils.Limiters{utils.NewRateLimiter(rate)}, nil
+}
 func tlsBytes(cert, key string) (certBytes, keyBytes []byte, err error) {
 	certBytes, err = os.ReadFile(cert)
 	if err != nil {
@@ -160,3 +312,35 @@ func tlsBytes(cert, key string) (certBytes, keyBytes []byte, err error) {
 	}
 	return
 }
+
+// dryRunRules prints the rule of file which a request from src by user to
+// address hits.
+func dryRunRules(file, address, src, user string, geoIPDB []string) (err error) {
+	rules, err := utils.NewRules(file, 0)
+	if err != nil {
+		return
+	}
+	if len(geoIPDB) > 0 {
+		var geoIP *utils.GeoIP
+		if geoIP, err = utils.NewGeoIP(geoIPDB, 0); err != nil {
+			return
+		}
+		rules.SetGeoIP(geoIP)
+	}
+	if _, _, e := net.SplitHostPort(address); e != nil {
+		address = net.JoinHostPort(address, "80")
+	}
+	var srcIP net.IP
+	if src != "" {
+		if srcIP = net.ParseIP(src); srcIP == nil {
+			return fmt.Errorf("invalid client ip %s", src)
+		}
+	}
+	route, ok := rules.Match(address, srcIP, user)
+	if !ok {
+		fmt.Printf("%s matches no rule, it is routed by --blocked and --direct\n", address)
+		return
+	}
+	fmt.Printf("%s matches line %d: %s\nroute: %s\n", address, route.Line, route.Rule, route)
+	return
+}
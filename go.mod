@@ -4,6 +4,9 @@ go 1.19
 
 require (
 	github.com/stretchr/testify v1.8.0
+	golang.org/x/crypto v0.11.0
+	golang.org/x/sys v0.10.0
+	golang.org/x/term v0.10.0
 	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
 )
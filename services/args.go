@@ -1,10 +1,15 @@
 package services
 
+import "github.com/c3b2a7/goproxy/utils"
+
 const (
 	TYPE_TCP     = "tcp"
 	TYPE_UDP     = "udp"
 	TYPE_HTTP    = "http"
+	TYPE_HTTPS   = "https"
 	TYPE_TLS     = "tls"
+	TYPE_SOCKS   = "socks"
+	TYPE_SOCKS5  = "socks5"
 	CONN_CONTROL = uint8(1)
 	CONN_SERVER  = uint8(2)
 	CONN_CLIENT  = uint8(3)
@@ -15,6 +20,10 @@ type Args struct {
 	Parent    *string
 	CertBytes []byte
 	KeyBytes  []byte
+	IPFilter  *utils.IPFilter
+	IPQuota   *utils.Quota
+	Upload    utils.Limiters
+	Download  utils.Limiters
 }
 type TunnelServerArgs struct {
 	Args
@@ -35,22 +44,56 @@ type TunnelBridgeArgs struct {
 type TCPArgs struct {
 	Args
 	ParentType          *string
+	LBMethod            *string
+	ParentAuth          *string
+	Target              *string
 	IsTLS               *bool
 	Timeout             *int
 	PoolSize            *int
 	CheckParentInterval *int
 }
 
+// UserArgs are the args of the auth of clients and of the limits of their
+// users.
+type UserArgs struct {
+	AuthFile          *string
+	Auth              *[]string
+	AuthURL           *string
+	AuthCmd           *string
+	AuthTimeout       *int
+	AuthCache         *int
+	AuthMaxFails      *int
+	AuthFailWindow    *int
+	AuthBanTime       *int
+	AuthMaxBanTime    *int
+	AuthBanFile       *string
+	UserLimit         *[]string
+	UserLimitFile     *string
+	UserLimitInterval *int
+	MaxConnsPerUser   *int
+	ConnRatePerUser   *float64
+}
+
 type HTTPArgs struct {
 	Args
+	UserArgs
 	Always               *bool
 	HTTPTimeout          *int
 	Interval             *int
 	Blocked              *string
 	Direct               *string
-	AuthFile             *string
-	Auth                 *[]string
+	ListRefresh          *int
+	ListCacheDir         *string
+	CheckerStateFile     *string
+	CheckerStateInterval *int
+	CheckerStateMaxAge   *int
+	CheckerMaxHosts      *int
+	CheckerTTL           *int
+	CheckerHalfLife      *int
+	CheckerProbes        *int
 	ParentType           *string
+	ParentAuth           *string
+	LBMethod             *string
 	LocalType            *string
 	Timeout              *int
 	PoolSize             *int
@@ -60,10 +103,52 @@ type HTTPArgs struct {
 	AutoMapping          *bool
 	CheckMappingInterval *int
 	IPResolver           *[]string
+	ACLFile              *string
+	Rules                *string
+	RulesInterval        *int
+	GeoIPDB              *[]string
+	GeoIPInterval        *int
+	GeoIPDirect          *string
+	Race                 *bool
+	RaceDelay            *int
+	MaxHeaderSize        *int
+	HeaderTimeout        *int
+}
+type SOCKSArgs struct {
+	Args
+	UserArgs
+	Always               *bool
+	HTTPTimeout          *int
+	Interval             *int
+	Blocked              *string
+	Direct               *string
+	ListRefresh          *int
+	ListCacheDir         *string
+	CheckerStateFile     *string
+	CheckerStateInterval *int
+	CheckerStateMaxAge   *int
+	CheckerMaxHosts      *int
+	CheckerTTL           *int
+	CheckerHalfLife      *int
+	CheckerProbes        *int
+	ParentType           *string
+	ParentAuth           *string
+	LBMethod             *string
+	LocalType            *string
+	Timeout              *int
+	PoolSize             *int
+	CheckParentInterval  *int
+	MagicUser            *bool
+	UDPTimeout           *int
+	MappingFile          *string
+	AutoMapping          *bool
+	CheckMappingInterval *int
+	IPResolver           *[]string
 }
 type UDPArgs struct {
 	Args
 	ParentType          *string
+	LBMethod            *string
 	Timeout             *int
 	PoolSize            *int
 	CheckParentInterval *int
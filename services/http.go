@@ -1,6 +1,8 @@
 package services
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/c3b2a7/goproxy/utils"
 	"io"
@@ -8,30 +10,42 @@ import (
 	"net"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// maxResponseHeadSize limits the response heads read from upstream servers,
+// which are trusted more than clients but may carry large cookies.
+const maxResponseHeadSize = 64 * 1024
+
 type HTTP struct {
 	cfg        HTTPArgs
-	outPool    utils.OutPool
+	parents    *utils.ParentGroup
 	checker    utils.Checker
-	basicAuth  utils.BasicAuth
 	ipResolver utils.IPResolver
 	mapping    utils.Mapping
+	acl        *utils.ACL
+	rules      *utils.Rules
+	geoIP      *utils.GeoIP
+	geoDirect  map[string]bool
+	users
 }
 
 func NewHTTP() Service {
 	return &HTTP{
-		cfg:       HTTPArgs{},
-		outPool:   utils.OutPool{},
-		checker:   utils.Checker{},
-		basicAuth: utils.BasicAuth{},
+		cfg:     HTTPArgs{},
+		checker: utils.Checker{},
 	}
 }
 func (s *HTTP) InitService() {
-	s.InitBasicAuth()
 	if *s.cfg.Parent != "" {
-		s.checker = utils.NewChecker(*s.cfg.HTTPTimeout, int64(*s.cfg.Interval), *s.cfg.Blocked, *s.cfg.Direct)
+		s.checker = utils.NewChecker(*s.cfg.HTTPTimeout, int64(*s.cfg.Interval), *s.cfg.Blocked, *s.cfg.Direct, *s.cfg.ListRefresh, *s.cfg.ListCacheDir,
+			*s.cfg.CheckerStateFile, *s.cfg.CheckerStateInterval, *s.cfg.CheckerStateMaxAge, utils.CheckerLimits{
+				MaxHosts: *s.cfg.CheckerMaxHosts,
+				TTL:      time.Duration(*s.cfg.CheckerTTL) * time.Second,
+				HalfLife: time.Duration(*s.cfg.CheckerHalfLife) * time.Second,
+				Probes:   *s.cfg.CheckerProbes,
+			})
 	}
 }
 
@@ -54,8 +68,11 @@ func (s *HTTP) InitMapping() {
 }
 
 func (s *HTTP) StopService() {
-	if s.outPool.Pool != nil {
-		s.outPool.Pool.ReleaseAll()
+	if s.parents != nil {
+		s.parents.ReleaseAll()
+	}
+	if err := s.checker.SaveState(); err != nil {
+		log.Printf("save checker state fail, err: %s", err)
 	}
 }
 func (s *HTTP) Start(args interface{}) (err error) {
@@ -68,11 +85,43 @@ func (s *HTTP) Start(args interface{}) (err error) {
 		s.InitMapping()
 	}
 
+	if *s.cfg.ACLFile != "" {
+		if s.acl, err = utils.LoadACL(*s.cfg.ACLFile); err != nil {
+			return fmt.Errorf("acl-file ERR:%s", err)
+		}
+	}
+	if len(*s.cfg.GeoIPDB) > 0 {
+		if s.geoIP, err = utils.NewGeoIP(*s.cfg.GeoIPDB, *s.cfg.GeoIPInterval); err != nil {
+			return fmt.Errorf("geoip-db ERR:%s", err)
+		}
+	}
+	if *s.cfg.GeoIPDirect != "" {
+		if s.geoIP == nil {
+			return fmt.Errorf("geoip-direct ERR:no --geoip-db")
+		}
+		s.geoDirect = map[string]bool{}
+		for _, country := range strings.Split(*s.cfg.GeoIPDirect, ",") {
+			s.geoDirect[strings.ToUpper(strings.TrimSpace(country))] = true
+		}
+	}
+	if *s.cfg.Rules != "" {
+		if s.rules, err = utils.NewRules(*s.cfg.Rules, *s.cfg.RulesInterval); err != nil {
+			return fmt.Errorf("rules ERR:%s", err)
+		}
+		s.rules.SetGeoIP(s.geoIP)
+	}
+
+	if err = s.InitUsers(s.cfg.UserArgs, s.cfg.Download, s.cfg.Upload); err != nil {
+		return
+	}
+
 	s.InitService()
 
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetIPFilter(s.cfg.IPFilter)
+	sc.SetQuota(s.cfg.IPQuota, utils.RejectOverQuota)
 	if *s.cfg.LocalType == TYPE_TCP {
 		err = sc.ListenTCP(s.callback)
 	} else {
@@ -88,46 +137,211 @@ func (s *HTTP) Start(args interface{}) (err error) {
 func (s *HTTP) Clean() {
 	s.StopService()
 }
+
+// httpUpstream is the server side of a persistent client conn, it is reused
+// as long as consecutive requests take the same route.
+type httpUpstream struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	key    string
+	bound  bool
+}
+
 func (s *HTTP) callback(inConn net.Conn) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Printf("http(s) conn handler crashed with err : %s \nstack: %s", err, string(debug.Stack()))
 		}
 	}()
-	req, err := utils.NewHTTPRequest(&inConn, 4096, s.IsBasicAuth(), &s.basicAuth)
-	if err != nil {
-		if err != io.EOF {
-			log.Printf("decoder error, form %s, ERR:%s", inConn.RemoteAddr(), err)
-		}
-		utils.CloseConn(&inConn)
+	reader := bufio.NewReader(inConn)
+	inConn = utils.NewBufferedConn(inConn, reader)
+	if *s.cfg.HeaderTimeout > 0 {
+		inConn.SetReadDeadline(time.Now().Add(time.Duration(*s.cfg.HeaderTimeout) * time.Millisecond))
+	}
+	if version, err := reader.Peek(1); err == nil && (version[0] == utils.SOCKS4Version || version[0] == utils.SOCKS5Version) {
+		s.SOCKS(&inConn, reader, version[0])
 		return
 	}
-	address := req.Host
-
-	useProxy := true
-	if *s.cfg.Parent == "" {
-		useProxy = false
-	} else if *s.cfg.Always {
-		useProxy = true
-	} else {
+	basicAuth := s.authGuard.Guard(s.basicAuth, inConn.RemoteAddr())
+	upstream := &httpUpstream{}
+	// the user holding a slot of the user quota for this conn
+	quotaUser := ""
+	defer func() {
+		if !upstream.bound {
+			utils.CloseConn(&upstream.conn)
+		}
+	}()
+	for {
+		if *s.cfg.HeaderTimeout > 0 {
+			inConn.SetReadDeadline(time.Now().Add(time.Duration(*s.cfg.HeaderTimeout) * time.Millisecond))
+		}
+		req, err := utils.NewHTTPRequest(&inConn, reader, *s.cfg.MaxHeaderSize, s.IsBasicAuth(), basicAuth)
+		inConn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("decoder error, form %s, ERR:%s", inConn.RemoteAddr(), err)
+			}
+			utils.CloseConn(&inConn)
+			return
+		}
+		if s.userQuota != nil && req.User != "" {
+			if req.User == quotaUser {
+				err = s.userQuota.Allow(req.User)
+			} else if err = s.AcquireUser(&inConn, req.User); err == nil {
+				quotaUser = req.User
+			}
+			if err != nil {
+				log.Printf("rejected user %q from %s, %s", req.User, inConn.RemoteAddr(), err)
+				utils.WriteQuotaError(inConn, err)
+				utils.CloseConn(&inConn)
+				return
+			}
+		}
+		if ok, reason := s.CheckACL(req.User, req.Host); !ok {
+			log.Printf("%s, user %q from %s", reason, req.User, inConn.RemoteAddr())
+			utils.WriteHTTPError(inConn, 403, reason)
+			utils.CloseConn(&inConn)
+			return
+		}
+		address := req.Host
+		route := s.Route(&req, inConn.RemoteAddr())
+		if route.Action == utils.RouteReject {
+			reason := fmt.Sprintf("access to %s rejected by rule at line %d", address, route.Line)
+			log.Printf("%s, user %q from %s", reason, req.User, inConn.RemoteAddr())
+			utils.WriteHTTPError(inConn, 403, reason)
+			utils.CloseConn(&inConn)
+			return
+		}
+		keepAlive := false
 		if req.IsHTTPS() {
-			s.checker.Add(address, true, req.Method, "", nil)
+			err = s.OutToTCP(route, address, &inConn, &req)
 		} else {
-			s.checker.Add(address, false, req.Method, req.URL, req.HeadBuf)
+			keepAlive, err = s.OutToHTTP(route, address, &inConn, reader, &req, upstream)
+		}
+		if err != nil {
+			if route.Action != utils.RouteParent {
+				log.Printf("connect to %s fail, err: %s", address, err)
+			} else {
+				log.Printf("connect to %s parent %s fail, err: %s", *s.cfg.ParentType, *s.cfg.Parent, err)
+			}
+			utils.CloseConn(&inConn)
+			return
+		}
+		if !keepAlive {
+			if !req.IsHTTPS() && !upstream.bound {
+				utils.CloseConn(&inConn)
+			}
+			return
 		}
-		useProxy, _, _ = s.checker.IsBlocked(req.Host)
 	}
-	err = s.OutToTCP(useProxy, address, &inConn, &req)
-	if err != nil {
-		if *s.cfg.Parent == "" {
-			log.Printf("connect to %s fail, err: %s", address, err)
-		} else {
-			log.Printf("connect to %s parent %s fail, err: %s", *s.cfg.ParentType, *s.cfg.Parent, err)
+}
+
+// CheckACL reports whether user may connect to address, every destination is
+// allowed without an acl file.
+func (s *HTTP) CheckACL(user, address string) (ok bool, reason string) {
+	if s.acl == nil {
+		return true, ""
+	}
+	return s.acl.Check(user, address)
+}
+
+// CheckDialed checks the ip outConn was dialled to for user by the acl, see
+// ACL.CheckDialed.
+func (s *HTTP) CheckDialed(user, address string, outConn net.Conn) (err error) {
+	if s.acl == nil {
+		return
+	}
+	addr, ok := outConn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	if ok, reason := s.acl.CheckDialed(user, address, addr.IP); !ok {
+		return errors.New(reason)
+	}
+	return
+}
+
+// Route decides the route of req from client.
+func (s *HTTP) Route(req *utils.HTTPRequest, client net.Addr) (route utils.Route) {
+	if req.IsHTTPS() {
+		return s.RouteFor(req.Host, req.User, client, true, req.Method, "", nil)
+	}
+	return s.RouteFor(req.Host, req.User, client, false, req.Method, req.URL, req.HeadBuf)
+}
+
+// RouteFor decides the route of a request from client by user to address by
+// the rules, requests which match no rule go to the parent if IsUseProxyFor
+// says so, or race if IsRaceFor does.
+func (s *HTTP) RouteFor(address, user string, client net.Addr, isHTTPS bool, method, URL string, data []byte) (route utils.Route) {
+	if s.rules != nil {
+		clientIP, _, _ := net.SplitHostPort(client.String())
+		if route, ok := s.rules.Match(address, net.ParseIP(clientIP), user); ok {
+			return route
 		}
-		utils.CloseConn(&inConn)
 	}
+	country := s.CountryFor(address)
+	useProxy := s.IsUseProxyFor(address, country, isHTTPS, method, URL, data)
+	if s.IsRaceFor(address, country) {
+		return utils.Route{Action: utils.RouteRace}
+	}
+	if useProxy {
+		return utils.Route{Action: utils.RouteParent}
+	}
+	return utils.Route{Action: utils.RouteDirect}
 }
-func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *utils.HTTPRequest) (err error) {
+
+// CountryFor returns the geoip country of address for --geoip-direct, it is
+// looked up once per request since it may resolve the host. It is "" if the
+// country is unknown or not needed, which is when a list routes address.
+func (s *HTTP) CountryFor(address string) (country string) {
+	if s.geoDirect == nil || *s.cfg.Parent == "" || *s.cfg.Always {
+		return
+	}
+	if listed, _ := s.checker.InList(address); !listed {
+		country, _ = s.geoIP.LookupHost(address)
+	}
+	return
+}
+
+// IsRaceFor reports whether a request to address races direct against the
+// parent, with --race for addresses neither the geoip nor the checker
+// routes yet. country is that of CountryFor, IsUseProxyFor must have added
+// address to the checker.
+func (s *HTTP) IsRaceFor(address, country string) bool {
+	if !*s.cfg.Race || *s.cfg.Parent == "" || *s.cfg.Always || *s.cfg.MagicHeader != "" {
+		return false
+	}
+	if country != "" {
+		return false
+	}
+	return s.checker.NeedRace(address)
+}
+
+// IsUseProxyFor decides the route of a request to address, country is that
+// of CountryFor and the other arguments are those of Checker.Add. With
+// --geoip-direct, an address in neither the blocked nor the direct list goes
+// direct if it is in one of the countries and to the parent otherwise,
+// instead of by what the checker learned.
+func (s *HTTP) IsUseProxyFor(address, country string, isHTTPS bool, method, URL string, data []byte) (useProxy bool) {
+	if *s.cfg.Parent == "" {
+		return false
+	}
+	if *s.cfg.Always {
+		return true
+	}
+	s.checker.Add(address, isHTTPS, method, URL, data)
+	if s.geoDirect != nil {
+		if listed, blocked := s.checker.InList(address); listed {
+			return blocked
+		}
+		if country != "" {
+			return !s.geoDirect[country]
+		}
+	}
+	useProxy, _, _ = s.checker.IsBlocked(address)
+	return
+}
+func (s *HTTP) OutToTCP(route utils.Route, address string, inConn *net.Conn, req *utils.HTTPRequest) (err error) {
 	inAddr := (*inConn).RemoteAddr().String()
 	inLocalAddr := (*inConn).LocalAddr().String()
 	if s.IsDeadLoop(inLocalAddr, req.Host) {
@@ -135,120 +349,547 @@ func (s *HTTP) OutToTCP(useProxy bool, address string, inConn *net.Conn, req *ut
 		err = fmt.Errorf("dead loop detected , %s", req.Host)
 		return
 	}
+	laddr, err := s.GetLocalAddr(route, req)
+	if err != nil {
+		return
+	}
 	var outConn net.Conn
-	var _outConn interface{}
-	if useProxy {
-		_outConn, err = s.outPool.Pool.Get()
-		if err == nil {
-			outConn = _outConn.(net.Conn)
+	// the parent conn of a race is a tunnel already
+	raced := route.Action == utils.RouteRace
+	if raced {
+		if route, outConn, err = s.Race(address, (*inConn).RemoteAddr()); err != nil {
+			return
 		}
-	} else {
-		var laddr string
-		if *s.cfg.MagicHeader != "" {
-			if outbound, _ := req.GetHeader(*s.cfg.MagicHeader); outbound != "" {
-				req.DelHeader(*s.cfg.MagicHeader)
-				if laddr = s.mapping.Get(outbound); laddr == "" {
-					return fmt.Errorf("no mapping for outbound: %s", outbound)
-				}
-			} else {
-				return fmt.Errorf("not found %s in request headers", *s.cfg.MagicHeader)
-			}
+	} else if route.Action == utils.RouteParent && s.IsHTTPParent() {
+		if outConn, err = s.ParentConnect(route, address, (*inConn).RemoteAddr()); err != nil {
+			utils.WriteHTTPError(*inConn, 502, err.Error())
+			return
 		}
-		if laddr != "" {
-			timeout := time.Duration(*s.cfg.Timeout) * time.Millisecond
-			outConn, err = utils.ConnectHostWithLAddr(address, laddr+":0", timeout)
-		} else {
-			outConn, err = utils.ConnectHost(address, *s.cfg.Timeout)
+	} else if outConn, err = s.GetOutConn(route, address, laddr, (*inConn).RemoteAddr()); err != nil {
+		if s.isCheckerDirect(route, laddr) {
+			s.directFailed(address, err, true)
+			return s.OutToTCP(utils.Route{Action: utils.RouteParent}, address, inConn, req)
 		}
-	}
-	if err != nil {
 		return
 	}
+	useProxy := route.Action == utils.RouteParent
+	if !useProxy {
+		if err = s.CheckDialed(req.User, address, outConn); err != nil {
+			utils.CloseConn(&outConn)
+			utils.WriteHTTPError(*inConn, 403, err.Error())
+			return
+		}
+	}
+	download, upload := s.Limiters(req.User)
 
-	outAddr := outConn.RemoteAddr().String()
-	outLocalAddr := outConn.LocalAddr().String()
-
-	if req.IsHTTPS() && !useProxy {
+	if useProxy && s.IsHTTPParent() && !raced {
+		req.HTTPSReply()
+	} else if req.IsHTTPS() && (!useProxy || raced || *s.cfg.ParentType == TYPE_SOCKS5) {
 		req.HTTPSReply()
+		if s.isCheckerDirect(route, laddr) {
+			if outConn, err = s.probeDirect(address, outConn, inConn, upload); err != nil {
+				return
+			}
+		}
 	} else {
 		req.RemoveHopByHopHeaders()
 		outConn.Write(req.HeadBuf)
 	}
-	utils.IoBind(*inConn, outConn, func(isSrcErr bool, err error) {
+	outAddr := outConn.RemoteAddr().String()
+	outLocalAddr := outConn.LocalAddr().String()
+	utils.IoBindLimit(*inConn, outConn, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s - %s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
-	}, func(n int, d bool) {}, 0)
+	}, func(n int, d bool) {}, download, upload)
 	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, req.Host)
 	return
 }
-func (s *HTTP) OutToUDP(inConn *net.Conn) (err error) {
-	return
+
+// isCheckerDirect reports whether route goes direct from laddr only because
+// the checker does not take the target as blocked, such requests go on
+// through the parent when the target fails them.
+func (s *HTTP) isCheckerDirect(route utils.Route, laddr string) bool {
+	return route.Action == utils.RouteDirect && route.Line == 0 && laddr == "" && *s.cfg.Parent != "" && !*s.cfg.Always
 }
-func (s *HTTP) InitOutConnPool() {
-	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP {
-		//dur int, isTLS bool, certBytes, keyBytes []byte,
-		//parent string, timeout int, InitialCap int, MaxCap int
-		s.outPool = utils.NewOutPool(
-			*s.cfg.CheckParentInterval,
-			*s.cfg.ParentType == TYPE_TLS,
-			s.cfg.CertBytes, s.cfg.KeyBytes,
-			*s.cfg.Parent,
-			*s.cfg.Timeout,
-			*s.cfg.PoolSize,
-			*s.cfg.PoolSize*2,
-		)
-	}
-}
-func (s *HTTP) InitBasicAuth() (err error) {
-	s.basicAuth = utils.NewBasicAuth()
-	if *s.cfg.AuthFile != "" {
-		var n = 0
-		n, err = s.basicAuth.AddFromFile(*s.cfg.AuthFile)
-		if err != nil {
-			err = fmt.Errorf("auth-file ERR:%s", err)
-			return
+
+// directFailed counts the failure of a direct request to address, retry tells
+// whether it goes on through the parent.
+func (s *HTTP) directFailed(address string, err error, retry bool) {
+	s.checker.Failed(address, err)
+	if retry {
+		log.Printf("direct to %s fail, retry through parent, err: %s", address, err)
+	}
+}
+
+// probeDirect waits for the first bytes of a tunnel the checker sent direct
+// from either side. A tls client hello is relayed alone and if the target
+// resets or closes the tunnel before answering, which is how blocked tls
+// handshakes often end, it is replayed through the parent. Other tunnels,
+// and those the target speaks first in, are not probed. It returns the conn
+// the tunnel goes on with, *inConn is replaced by a conn which still returns
+// the bytes read ahead.
+func (s *HTTP) probeDirect(address string, outConn net.Conn, inConn *net.Conn, upload utils.Limiters) (conn net.Conn, err error) {
+	client := utils.NewPeekConn(*inConn, 32*1024)
+	target := utils.NewPeekConn(outConn, 32*1024)
+	*inConn = client
+	select {
+	case <-target.Peeked():
+		return target, nil
+	case <-client.Peeked():
+	}
+	// a read of no bytes is not taken as tls
+	first, err := client.First()
+	if err != nil || len(first) == 0 || first[0] != 0x16 {
+		return target, nil
+	}
+	client.Take()
+	if _, err = upload.Writer(target).Write(first); err == nil {
+		select {
+		case <-target.Peeked():
+			var answer []byte
+			if answer, err = target.First(); len(answer) > 0 {
+				return target, nil
+			}
+		case <-time.After(time.Duration(*s.cfg.Timeout) * time.Millisecond):
+			// a slow target is not taken as failed
+			return target, nil
 		}
-		log.Printf("auth data added from file %d , total:%d", n, s.basicAuth.Total())
 	}
-	if len(*s.cfg.Auth) > 0 {
-		n := s.basicAuth.Add(*s.cfg.Auth)
-		log.Printf("auth data added %d, total:%d", n, s.basicAuth.Total())
+	utils.CloseConn(&outConn)
+	s.directFailed(address, err, true)
+	if conn, err = s.ParentConnect(utils.Route{Action: utils.RouteParent}, address, (*inConn).RemoteAddr()); err != nil {
+		return
+	}
+	if _, err = upload.Writer(conn).Write(first); err != nil {
+		utils.CloseConn(&conn)
 	}
 	return
 }
-func (s *HTTP) IsBasicAuth() bool {
-	return *s.cfg.AuthFile != "" || len(*s.cfg.Auth) > 0
-}
-func (s *HTTP) IsDeadLoop(inLocalAddr string, host string) bool {
-	inIP, inPort, err := net.SplitHostPort(inLocalAddr)
+
+// OutToHTTP forwards one plain http request with its body and relays the
+// response back, keepAlive reports whether inConn can carry the next request.
+func (s *HTTP) OutToHTTP(route utils.Route, address string, inConn *net.Conn, reader *bufio.Reader, req *utils.HTTPRequest, upstream *httpUpstream) (keepAlive bool, err error) {
+	chunked, length, err := req.BodyFraming()
 	if err != nil {
-		return false
+		utils.WriteHTTPError(*inConn, 400, err.Error())
+		return
 	}
-	outDomain, outPort, err := net.SplitHostPort(host)
+	hasBody := chunked || length > 0
+	laddr, err := s.GetLocalAddr(route, req)
 	if err != nil {
-		return false
+		return
+	}
+	// the conn which won a race, the parent one is a tunnel already
+	var racedConn net.Conn
+	defer utils.CloseConn(&racedConn)
+	raced := route.Action == utils.RouteRace
+	if raced {
+		if s.IsDeadLoop((*inConn).LocalAddr().String(), req.Host) {
+			err = fmt.Errorf("dead loop detected , %s", req.Host)
+			return
+		}
+		if route, racedConn, err = s.Race(address, (*inConn).RemoteAddr()); err != nil {
+			return
+		}
 	}
-	if inPort == outPort {
-		var outIPs []net.IP
-		outIPs, err = net.LookupIP(outDomain)
-		if err == nil {
-			for _, ip := range outIPs {
-				if ip.String() == inIP || s.mapping.Get(ip.String()) != "" {
-					return true
+	useProxy := route.Action == utils.RouteParent
+	key := address + "@" + laddr
+	if useProxy {
+		key = route.String()
+		if *s.cfg.ParentType == TYPE_SOCKS5 || raced {
+			// a socks5 parent tunnels to one address
+			key = address + "@" + route.String()
+		}
+	}
+	req.RemoveHopByHopHeaders()
+	head := req.HeadBuf
+	if useProxy && s.IsHTTPParent() && !raced {
+		head = req.ProxyHead(s.ParentAuth())
+	}
+	download, upload := s.Limiters(req.User)
+
+	var resp utils.HTTPResponse
+	var bodyErr chan error
+	// interim tells whether 1xx heads reached the client already
+	var interim bool
+	for {
+		reused := upstream.conn != nil && upstream.key == key
+		if !reused {
+			utils.CloseConn(&upstream.conn)
+			upstream.conn = nil
+			inLocalAddr := (*inConn).LocalAddr().String()
+			if s.IsDeadLoop(inLocalAddr, req.Host) {
+				err = fmt.Errorf("dead loop detected , %s", req.Host)
+				return
+			}
+			var outConn net.Conn
+			if racedConn != nil {
+				outConn, racedConn = racedConn, nil
+			} else if outConn, err = s.GetOutConn(route, address, laddr, (*inConn).RemoteAddr()); err != nil {
+				if s.isCheckerDirect(route, laddr) {
+					s.directFailed(address, err, true)
+					return s.OutToHTTP(utils.Route{Action: utils.RouteParent}, address, inConn, reader, req, upstream)
 				}
+				return
+			}
+			upstream.reader = bufio.NewReader(outConn)
+			upstream.conn = utils.NewBufferedConn(outConn, upstream.reader)
+			upstream.key = key
+			log.Printf("conn %s - %s - %s - %s connected [%s]", (*inConn).RemoteAddr(), inLocalAddr, outConn.LocalAddr(), outConn.RemoteAddr(), req.Host)
+		}
+		if !useProxy {
+			if err = s.CheckDialed(req.User, address, upstream.conn); err != nil {
+				utils.CloseConn(&upstream.conn)
+				upstream.conn = nil
+				utils.WriteHTTPError(*inConn, 403, err.Error())
+				return
 			}
 		}
-		interfaceIPs, err := utils.GetAllInterfaceAddr()
-		if err == nil {
-			for _, localIP := range interfaceIPs {
-				for _, outIP := range outIPs {
-					if localIP.Equal(outIP) {
-						return true
-					}
+		if _, err = upstream.conn.Write(head); err == nil {
+			if hasBody {
+				bodyErr = make(chan error, 1)
+				go func(outConn net.Conn) {
+					bodyErr <- utils.CopyHTTPBody(upload.Writer(outConn), reader, chunked, length)
+				}(upstream.conn)
+			}
+			resp, interim, err = s.readResponse(inConn, upstream.reader)
+		}
+		if err != nil {
+			utils.CloseConn(&upstream.conn)
+			upstream.conn = nil
+			// an idle persistent conn may have been closed by the server, a
+			// safe request without body can be replayed on a new conn as
+			// long as nothing reached the client
+			if reused && !hasBody && !interim && req.IsSafe() {
+				continue
+			}
+			if s.isCheckerDirect(route, laddr) {
+				// a request which changes nothing can be sent again unless
+				// the client got part of the answer already
+				retry := !interim && !hasBody && (req.Method == "GET" || req.Method == "HEAD")
+				s.directFailed(address, err, retry)
+				if retry {
+					return s.OutToHTTP(utils.Route{Action: utils.RouteParent}, address, inConn, reader, req, upstream)
 				}
 			}
+			return
+		}
+		break
+	}
+	if resp.StatusCode == 101 {
+		resp.RemoveHopByHopHeaders(false)
+		if _, err = (*inConn).Write(resp.HeadBuf); err != nil {
+			return
+		}
+		if hasBody {
+			if err = <-bodyErr; err != nil {
+				return
+			}
+		}
+		upstream.bound = true
+		outConn := upstream.conn
+		utils.IoBindLimit(*inConn, outConn, func(isSrcErr bool, err error) {
+			log.Printf("conn %s - %s - %s - %s released [%s]", (*inConn).RemoteAddr(), (*inConn).LocalAddr(), outConn.LocalAddr(), outConn.RemoteAddr(), req.Host)
+			utils.CloseConn(inConn)
+			utils.CloseConn(&outConn)
+		}, func(n int, d bool) {}, download, upload)
+		return
+	}
+	respChunked, respLength, err := resp.BodyFraming(req.Method)
+	if err != nil {
+		return
+	}
+	delimited := respChunked || respLength >= 0
+	upstreamKeepAlive := delimited && resp.IsKeepAlive()
+	resp.RemoveHopByHopHeaders(delimited && req.IsKeepAlive())
+	if _, err = (*inConn).Write(resp.HeadBuf); err != nil {
+		return
+	}
+	if err = utils.CopyHTTPBody(download.Writer(*inConn), upstream.reader, respChunked, respLength); err != nil {
+		return
+	}
+	if hasBody {
+		if err = <-bodyErr; err != nil {
+			return
+		}
+	}
+	if !upstreamKeepAlive {
+		utils.CloseConn(&upstream.conn)
+		upstream.conn = nil
+	}
+	keepAlive = delimited && req.IsKeepAlive()
+	return
+}
+
+// readResponse reads the final response head, interim 1xx responses except
+// 101 are relayed to the client on the way, interim tells whether there were
+// any.
+func (s *HTTP) readResponse(inConn *net.Conn, reader *bufio.Reader) (resp utils.HTTPResponse, interim bool, err error) {
+	for {
+		resp, err = utils.ReadHTTPResponse(reader, maxResponseHeadSize)
+		if err != nil {
+			return
+		}
+		if resp.StatusCode/100 != 1 || resp.StatusCode == 101 {
+			return
+		}
+		interim = true
+		if _, err = (*inConn).Write(resp.HeadBuf); err != nil {
+			return
+		}
+	}
+}
+
+// GetLocalAddr returns the local address used to connect to the target
+// directly, selected by an outbound route or by the magic header if it is
+// set.
+func (s *HTTP) GetLocalAddr(route utils.Route, req *utils.HTTPRequest) (laddr string, err error) {
+	if route.Action == utils.RouteOutbound {
+		if *s.cfg.MagicHeader != "" {
+			req.DelHeader(*s.cfg.MagicHeader)
+		}
+		return s.OutboundAddr(route.Name)
+	}
+	if route.Action == utils.RouteParent || *s.cfg.MagicHeader == "" {
+		return
+	}
+	if outbound, _ := req.GetHeader(*s.cfg.MagicHeader); outbound != "" {
+		req.DelHeader(*s.cfg.MagicHeader)
+		if laddr = s.mapping.Get(outbound); laddr == "" {
+			err = fmt.Errorf("no mapping for outbound: %s", outbound)
+		}
+	} else {
+		err = fmt.Errorf("not found %s in request headers", *s.cfg.MagicHeader)
+	}
+	return
+}
+
+// OutboundAddr returns the local address of the outbound name, which is
+// mapped to one or is a local ip itself.
+func (s *HTTP) OutboundAddr(name string) (laddr string, err error) {
+	if s.mapping != nil {
+		if laddr = s.mapping.Get(name); laddr != "" {
+			return
+		}
+	}
+	if net.ParseIP(name) != nil {
+		return name, nil
+	}
+	return "", fmt.Errorf("no mapping for outbound: %s", name)
+}
+
+// GetOutConn connects to address directly or through the parent selected for
+// client by route, a socks5 parent is asked to connect to address at once,
+// other parents are left to the caller.
+func (s *HTTP) GetOutConn(route utils.Route, address, laddr string, client net.Addr) (outConn net.Conn, err error) {
+	if route.Action == utils.RouteParent {
+		var handshake func(conn net.Conn) (net.Conn, error)
+		if *s.cfg.ParentType == TYPE_SOCKS5 {
+			handshake = func(conn net.Conn) (net.Conn, error) {
+				return conn, s.SOCKS5Connect(conn, address)
+			}
+		}
+		return s.parentConn(route, client, handshake)
+	}
+	if laddr != "" {
+		timeout := time.Duration(*s.cfg.Timeout) * time.Millisecond
+		return utils.ConnectHostWithLAddr(address, laddr+":0", timeout)
+	}
+	return utils.ConnectHost(address, *s.cfg.Timeout)
+}
+
+// parentConn returns a conn to the parent selected for client by route, the
+// next parent is tried when handshake fails, see utils.ParentGroup.Get.
+func (s *HTTP) parentConn(route utils.Route, client net.Addr, handshake func(conn net.Conn) (net.Conn, error)) (outConn net.Conn, err error) {
+	if s.parents == nil {
+		return nil, fmt.Errorf("no parent for route %s", route)
+	}
+	clientIP, _, _ := net.SplitHostPort(client.String())
+	if route.Name != "" {
+		outConn, _, err = s.parents.GetNamed(route.Name, clientIP, handshake)
+	} else {
+		outConn, _, err = s.parents.Get(clientIP, handshake)
+	}
+	return
+}
+
+// ParentConnect opens a tunnel to address through the parent selected for
+// client by route, with CONNECT if the parent is not a socks5 one.
+func (s *HTTP) ParentConnect(route utils.Route, address string, client net.Addr) (outConn net.Conn, err error) {
+	if *s.cfg.ParentType == TYPE_SOCKS5 {
+		return s.GetOutConn(route, address, "", client)
+	}
+	return s.parentConn(route, client, func(conn net.Conn) (net.Conn, error) {
+		return s.HTTPConnect(conn, address)
+	})
+}
+
+// Race connects to address directly and through the parent at once, happy
+// eyeballs style: the direct connect starts --race-delay milliseconds ahead
+// and the parent one is not tried if it connects within that. The first conn
+// wins, the parent one is a tunnel to address, see ParentConnect. The other
+// is closed once it connects, and both connect times go to the checker, so
+// the next requests take the faster path.
+func (s *HTTP) Race(address string, client net.Addr) (route utils.Route, outConn net.Conn, err error) {
+	type dial struct {
+		route utils.Route
+		conn  net.Conn
+		rtt   time.Duration
+		err   error
+	}
+	dials := make(chan dial, 2)
+	directDone := make(chan error, 1)
+	go func() {
+		start := time.Now()
+		conn, err := utils.ConnectHost(address, *s.cfg.Timeout)
+		directDone <- err
+		dials <- dial{utils.Route{Action: utils.RouteDirect}, conn, time.Since(start), err}
+	}()
+	go func() {
+		parent := utils.Route{Action: utils.RouteParent}
+		select {
+		case <-time.After(time.Duration(*s.cfg.RaceDelay) * time.Millisecond):
+		case err := <-directDone:
+			if err == nil {
+				dials <- dial{route: parent}
+				return
+			}
+		}
+		start := time.Now()
+		conn, err := s.ParentConnect(parent, address, client)
+		dials <- dial{parent, conn, time.Since(start), err}
+	}()
+	won := make(chan dial, 1)
+	go func() {
+		var directRTT, parentRTT time.Duration
+		var directErr error
+		var errs []string
+		winner := ""
+		for i := 0; i < 2; i++ {
+			d := <-dials
+			if d.route.Action == utils.RouteDirect {
+				directErr = d.err
+			}
+			if d.err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", d.route, d.err))
+				continue
+			}
+			if d.conn == nil {
+				continue
+			}
+			if d.route.Action == utils.RouteDirect {
+				directRTT = d.rtt
+			} else {
+				parentRTT = d.rtt
+			}
+			if winner != "" {
+				utils.CloseConn(&d.conn)
+				continue
+			}
+			winner = d.route.Action
+			won <- d
+		}
+		if winner == "" {
+			won <- dial{err: fmt.Errorf("race fail, %s", strings.Join(errs, ", "))}
+			winner = "none"
+		}
+		log.Printf("race to %s won by %s, direct %s, parent %s", address, winner, directRTT, parentRTT)
+		s.checker.Raced(address, directRTT, parentRTT, directErr)
+	}()
+	d := <-won
+	return d.route, d.conn, d.err
+}
+
+// HTTPConnect asks the parent at the other end of outConn for a tunnel to
+// address with CONNECT, outConn is closed on failure.
+func (s *HTTP) HTTPConnect(outConn net.Conn, address string) (tunnel net.Conn, err error) {
+	outConn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+	user, pass := s.ParentAuth()
+	tunnel, err = utils.HTTPConnect(outConn, address, user, pass)
+	outConn.SetDeadline(time.Time{})
+	if err != nil {
+		utils.CloseConn(&outConn)
+	}
+	return
+}
+
+// SOCKS5Connect asks the socks5 parent at the other end of outConn to connect
+// to address, outConn is closed on failure.
+func (s *HTTP) SOCKS5Connect(outConn net.Conn, address string) (err error) {
+	outConn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+	user, pass := s.ParentAuth()
+	err = utils.SOCKS5Connect(outConn, address, user, pass)
+	outConn.SetDeadline(time.Time{})
+	if err != nil {
+		utils.CloseConn(&outConn)
+	}
+	return
+}
+func (s *HTTP) OutToUDP(inConn *net.Conn) (err error) {
+	return
+}
+func (s *HTTP) InitOutConnPool() {
+	var newPool func(address string) utils.OutPool
+	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP || *s.cfg.ParentType == TYPE_SOCKS5 || s.IsHTTPParent() {
+		certBytes, keyBytes := s.cfg.CertBytes, s.cfg.KeyBytes
+		if s.IsHTTPParent() {
+			// a standard https parent does not know our cert
+			certBytes, keyBytes = nil, nil
+		}
+		newPool = func(address string) utils.OutPool {
+			//dur int, isTLS bool, certBytes, keyBytes []byte,
+			//parent string, timeout int, InitialCap int, MaxCap int
+			return utils.NewOutPool(
+				0,
+				*s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_HTTPS,
+				certBytes, keyBytes,
+				address,
+				*s.cfg.Timeout,
+				s.poolSize(),
+				s.poolSize()*2,
+			)
 		}
 	}
-	return false
+	var err error
+	// the parent group checks the parents, so the pools do not
+	s.parents, err = utils.NewParentGroup(*s.cfg.Parent, *s.cfg.LBMethod, *s.cfg.CheckParentInterval, *s.cfg.Timeout, newPool)
+	if err != nil {
+		log.Fatalf("parent ERR:%s", err)
+	}
+}
+
+// poolSize returns the number of conns dialed ahead to each parent. A socks5
+// or http parent drops conns which do not negotiate or send a request in
+// time, they are dialed when needed.
+func (s *HTTP) poolSize() int {
+	if *s.cfg.ParentType == TYPE_SOCKS5 || s.IsHTTPParent() {
+		return 0
+	}
+	return *s.cfg.PoolSize
+}
+
+// IsHTTPParent reports whether the parent is a standard http proxy rather
+// than another goproxy.
+func (s *HTTP) IsHTTPParent() bool {
+	return *s.cfg.ParentType == TYPE_HTTP || *s.cfg.ParentType == TYPE_HTTPS
+}
+
+// ParentAuth returns the credentials of a http or socks5 parent, user is ""
+// if it has none.
+func (s *HTTP) ParentAuth() (user, pass string) {
+	return splitUserPass(*s.cfg.ParentAuth)
+}
+
+// splitUserPass splits "user:pass", a value without ":" is a user without
+// password.
+func splitUserPass(userpass string) (user, pass string) {
+	u := strings.SplitN(userpass, ":", 2)
+	if len(u) == 2 {
+		return u[0], u[1]
+	}
+	return u[0], ""
+}
+func (s *HTTP) IsDeadLoop(inLocalAddr string, host string) bool {
+	return isDeadLoop(inLocalAddr, host, s.mapping)
 }
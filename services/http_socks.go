@@ -0,0 +1,171 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/c3b2a7/goproxy/utils"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// SOCKS serves a socks4/4a or socks5 client which connected to the http
+// port, with the auth and routing of http clients. version is the first byte
+// sent by the client. Only CONNECT is served, udp is left to the socks
+// service, which also serves the udp over tcp of child goproxies.
+func (s *HTTP) SOCKS(inConn *net.Conn, reader *bufio.Reader, version byte) {
+	var outbound, authUser string
+	var req utils.SOCKSRequest
+	var err error
+	if version == utils.SOCKS5Version {
+		var auth func(user, pass string) bool
+		if s.IsBasicAuth() || *s.cfg.MagicHeader != "" {
+			basicAuth := s.authGuard.Guard(s.basicAuth, (*inConn).RemoteAddr())
+			auth = func(user, pass string) bool {
+				if *s.cfg.MagicHeader != "" {
+					if i := strings.LastIndex(user, "@"); i != -1 {
+						user, outbound = user[:i], user[i+1:]
+					}
+				}
+				if !s.IsBasicAuth() {
+					return true
+				}
+				ok := basicAuth.Check(user + ":" + pass)
+				if *s.cfg.HeaderTimeout > 0 {
+					// the deadline is for the client, an --auth-url or
+					// --auth-cmd may take longer
+					(*inConn).SetReadDeadline(time.Now().Add(time.Duration(*s.cfg.HeaderTimeout) * time.Millisecond))
+				}
+				if !ok {
+					return false
+				}
+				authUser = user
+				return true
+			}
+		}
+		req, err = utils.NewSOCKS5Request(inConn, reader, auth)
+	} else {
+		var auth func(user string) bool
+		if s.IsBasicAuth() {
+			// socks4 can not carry a password
+			auth = func(user string) bool { return false }
+		}
+		req, err = utils.NewSOCKS4Request(inConn, reader, auth)
+	}
+	(*inConn).SetReadDeadline(time.Time{})
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("socks%d decoder error, from %s, ERR:%s", version, (*inConn).RemoteAddr(), err)
+		}
+		utils.CloseConn(inConn)
+		return
+	}
+	if err = s.AcquireUser(inConn, authUser); err != nil {
+		log.Printf("rejected user %q from %s, %s", authUser, (*inConn).RemoteAddr(), err)
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		utils.CloseConn(inConn)
+		return
+	}
+	if !req.IsConnect() {
+		req.Reply(utils.SOCKS5RepCommandNotSupported, nil)
+		log.Printf("socks%d command %d not supported, from %s", version, req.Cmd, (*inConn).RemoteAddr())
+		utils.CloseConn(inConn)
+		return
+	}
+	log.Printf("SOCKS%d CONNECT: %s", version, req.Host)
+	if ok, reason := s.CheckACL(authUser, req.Host); !ok {
+		log.Printf("%s, user %q from %s", reason, authUser, (*inConn).RemoteAddr())
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		utils.CloseConn(inConn)
+		return
+	}
+	address := req.Host
+	route := s.RouteFor(address, authUser, (*inConn).RemoteAddr(), true, "CONNECT", "", nil)
+	if route.Action == utils.RouteReject {
+		log.Printf("access to %s rejected by rule at line %d, user %q from %s", address, route.Line, authUser, (*inConn).RemoteAddr())
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		utils.CloseConn(inConn)
+		return
+	}
+	err = s.SOCKSOutToTCP(route, address, outbound, authUser, inConn, &req)
+	if err != nil {
+		if route.Action != utils.RouteParent {
+			log.Printf("connect to %s fail, err: %s", address, err)
+		} else {
+			log.Printf("connect to %s parent %s fail, err: %s", *s.cfg.ParentType, *s.cfg.Parent, err)
+		}
+		utils.CloseConn(inConn)
+	}
+}
+
+// SOCKSOutToTCP connects a socks client to address, the parent is asked
+// with CONNECT like for https clients.
+func (s *HTTP) SOCKSOutToTCP(route utils.Route, address, outbound, user string, inConn *net.Conn, req *utils.SOCKSRequest) (err error) {
+	useProxy := route.Action == utils.RouteParent
+	inAddr := (*inConn).RemoteAddr().String()
+	inLocalAddr := (*inConn).LocalAddr().String()
+	if s.IsDeadLoop(inLocalAddr, address) {
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		return fmt.Errorf("dead loop detected , %s", address)
+	}
+	var laddr string
+	if route.Action == utils.RouteOutbound {
+		if laddr, err = s.OutboundAddr(route.Name); err != nil {
+			req.Reply(utils.SOCKS5RepNotAllowed, nil)
+			return
+		}
+	} else if !useProxy && *s.cfg.MagicHeader != "" {
+		if outbound == "" {
+			req.Reply(utils.SOCKS5RepNotAllowed, nil)
+			return fmt.Errorf("not found outbound in socks username")
+		}
+		if laddr = s.mapping.Get(outbound); laddr == "" {
+			req.Reply(utils.SOCKS5RepNotAllowed, nil)
+			return fmt.Errorf("no mapping for outbound: %s", outbound)
+		}
+	}
+	var outConn net.Conn
+	if route.Action == utils.RouteRace {
+		route, outConn, err = s.Race(address, (*inConn).RemoteAddr())
+		useProxy = route.Action == utils.RouteParent
+	} else if useProxy {
+		outConn, err = s.ParentConnect(route, address, (*inConn).RemoteAddr())
+	} else if outConn, err = s.GetOutConn(route, address, laddr, (*inConn).RemoteAddr()); err != nil && s.isCheckerDirect(route, laddr) {
+		s.directFailed(address, err, true)
+		useProxy = true
+		outConn, err = s.ParentConnect(utils.Route{Action: utils.RouteParent}, address, (*inConn).RemoteAddr())
+	}
+	if err != nil {
+		req.Reply(socksRep(err), nil)
+		return
+	}
+	if !useProxy {
+		if err = s.CheckDialed(user, address, outConn); err != nil {
+			utils.CloseConn(&outConn)
+			req.Reply(utils.SOCKS5RepNotAllowed, nil)
+			return
+		}
+	}
+
+	outAddr := outConn.RemoteAddr().String()
+	outLocalAddr := outConn.LocalAddr().String()
+	if useProxy {
+		err = req.Reply(utils.SOCKS5RepSuccess, nil)
+	} else {
+		err = req.Reply(utils.SOCKS5RepSuccess, outConn.LocalAddr())
+	}
+	if err != nil {
+		utils.CloseConn(&outConn)
+		return
+	}
+	download, upload := s.Limiters(user)
+	utils.IoBindLimit(*inConn, outConn, func(isSrcErr bool, err error) {
+		log.Printf("conn %s - %s - %s - %s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
+		utils.CloseConn(inConn)
+		utils.CloseConn(&outConn)
+	}, func(n int, d bool) {}, download, upload)
+	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
+	return
+}
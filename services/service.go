@@ -2,7 +2,9 @@ package services
 
 import (
 	"fmt"
+	"github.com/c3b2a7/goproxy/utils"
 	"log"
+	"net"
 	"runtime/debug"
 )
 
@@ -46,3 +48,38 @@ func Run(name string) (service *ServiceItem, err error) {
 	}
 	return
 }
+
+// isDeadLoop reports whether host is the proxy itself, inLocalAddr is the
+// address a client connected to.
+func isDeadLoop(inLocalAddr string, host string, mapping utils.Mapping) bool {
+	inIP, inPort, err := net.SplitHostPort(inLocalAddr)
+	if err != nil {
+		return false
+	}
+	outDomain, outPort, err := net.SplitHostPort(host)
+	if err != nil {
+		return false
+	}
+	if inPort == outPort {
+		var outIPs []net.IP
+		outIPs, err = net.LookupIP(outDomain)
+		if err == nil {
+			for _, ip := range outIPs {
+				if ip.String() == inIP || mapping.Get(ip.String()) != "" {
+					return true
+				}
+			}
+		}
+		interfaceIPs, err := utils.GetAllInterfaceAddr()
+		if err == nil {
+			for _, localIP := range interfaceIPs {
+				for _, outIP := range outIPs {
+					if localIP.Equal(outIP) {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,303 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/c3b2a7/goproxy/utils"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type SOCKS struct {
+	cfg        SOCKSArgs
+	parents    *utils.ParentGroup
+	checker    utils.Checker
+	ipResolver utils.IPResolver
+	mapping    utils.Mapping
+	users
+}
+
+func NewSOCKS() Service {
+	return &SOCKS{
+		cfg:     SOCKSArgs{},
+		checker: utils.Checker{},
+		mapping: utils.NewInMemoryMapping(),
+	}
+}
+func (s *SOCKS) InitService() {
+	if *s.cfg.Parent != "" {
+		s.checker = utils.NewChecker(*s.cfg.HTTPTimeout, int64(*s.cfg.Interval), *s.cfg.Blocked, *s.cfg.Direct, *s.cfg.ListRefresh, *s.cfg.ListCacheDir,
+			*s.cfg.CheckerStateFile, *s.cfg.CheckerStateInterval, *s.cfg.CheckerStateMaxAge, utils.CheckerLimits{
+				MaxHosts: *s.cfg.CheckerMaxHosts,
+				TTL:      time.Duration(*s.cfg.CheckerTTL) * time.Second,
+				HalfLife: time.Duration(*s.cfg.CheckerHalfLife) * time.Second,
+				Probes:   *s.cfg.CheckerProbes,
+			})
+	}
+}
+
+func (s *SOCKS) InitMapping() {
+	s.mapping = utils.NewInMemoryMapping()
+	s.ipResolver, _ = utils.NewFallBackIPResolver(*s.cfg.IPResolver...)
+	logMapping := func(k, v string) {
+		s.mapping.Put(k, v)
+		log.Printf("detect mapping: %s -> %s", v, k)
+	}
+	if *s.cfg.AutoMapping {
+		utils.ResolveMapping(s.ipResolver, logMapping)
+		if interval := *s.cfg.CheckMappingInterval; interval > 0 {
+			utils.StartMonitor(s.ipResolver, s.mapping, time.Duration(interval)*time.Second)
+		}
+	}
+	if *s.cfg.MappingFile != "" {
+		utils.UnmarshalMapping(*s.cfg.MappingFile, logMapping)
+	}
+}
+
+func (s *SOCKS) StopService() {
+	if s.parents != nil {
+		s.parents.ReleaseAll()
+	}
+	if err := s.checker.SaveState(); err != nil {
+		log.Printf("save checker state fail, err: %s", err)
+	}
+}
+func (s *SOCKS) Start(args interface{}) (err error) {
+	s.cfg = args.(SOCKSArgs)
+	if *s.cfg.Parent != "" {
+		log.Printf("use %s parent %s", *s.cfg.ParentType, *s.cfg.Parent)
+		s.InitOutConnPool()
+	}
+	if *s.cfg.AutoMapping || *s.cfg.MappingFile != "" {
+		s.InitMapping()
+	}
+
+	if err = s.InitUsers(s.cfg.UserArgs, s.cfg.Download, s.cfg.Upload); err != nil {
+		return
+	}
+
+	s.InitService()
+
+	host, port, _ := net.SplitHostPort(*s.cfg.Local)
+	p, _ := strconv.Atoi(port)
+	sc := utils.NewServerChannel(host, p)
+	sc.SetIPFilter(s.cfg.IPFilter)
+	sc.SetQuota(s.cfg.IPQuota, utils.RejectOverQuota)
+	if *s.cfg.LocalType == TYPE_TCP {
+		err = sc.ListenTCP(s.callback)
+	} else {
+		err = sc.ListenTls(s.cfg.CertBytes, s.cfg.KeyBytes, s.callback)
+	}
+	if err != nil {
+		return
+	}
+	log.Printf("%s socks5 proxy on %s", *s.cfg.LocalType, (*sc.Listener).Addr())
+	return
+}
+
+func (s *SOCKS) Clean() {
+	s.StopService()
+}
+func (s *SOCKS) callback(inConn net.Conn) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("socks conn handler crashed with err : %s \nstack: %s", err, string(debug.Stack()))
+		}
+	}()
+	reader := bufio.NewReader(inConn)
+	inConn = utils.NewBufferedConn(inConn, reader)
+	var outbound, authUser string
+	var auth func(user, pass string) bool
+	if s.IsBasicAuth() || *s.cfg.MagicUser {
+		basicAuth := s.authGuard.Guard(s.basicAuth, inConn.RemoteAddr())
+		auth = func(user, pass string) bool {
+			if *s.cfg.MagicUser {
+				if i := strings.LastIndex(user, "@"); i != -1 {
+					user, outbound = user[:i], user[i+1:]
+				}
+			}
+			if !s.IsBasicAuth() {
+				return true
+			}
+			ok := basicAuth.Check(user + ":" + pass)
+			// the deadline is for the client, an --auth-url or --auth-cmd may
+			// take longer
+			inConn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+			if !ok {
+				return false
+			}
+			authUser = user
+			return true
+		}
+	}
+	inConn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+	req, err := utils.NewSOCKS5Request(&inConn, reader, auth)
+	inConn.SetDeadline(time.Time{})
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("socks decoder error, from %s, ERR:%s", inConn.RemoteAddr(), err)
+		}
+		utils.CloseConn(&inConn)
+		return
+	}
+	if err = s.AcquireUser(&inConn, authUser); err != nil {
+		log.Printf("rejected user %q from %s, %s", authUser, inConn.RemoteAddr(), err)
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		utils.CloseConn(&inConn)
+		return
+	}
+	if req.Cmd == utils.SOCKS5CmdUDPAssociate || req.Cmd == utils.SOCKS5CmdUDPOverTCP {
+		if req.Cmd == utils.SOCKS5CmdUDPAssociate {
+			err = s.UDPAssociate(authUser, &inConn, &req)
+		} else {
+			err = s.UDPOverTCP(authUser, &inConn, &req)
+		}
+		if err != nil {
+			log.Printf("udp associate from %s fail, err: %s", inConn.RemoteAddr(), err)
+			utils.CloseConn(&inConn)
+		}
+		return
+	}
+	if !req.IsConnect() {
+		req.Reply(utils.SOCKS5RepCommandNotSupported, nil)
+		log.Printf("socks command %d not supported, from %s", req.Cmd, inConn.RemoteAddr())
+		utils.CloseConn(&inConn)
+		return
+	}
+	log.Printf("CONNECT: %s", req.Host)
+	address := req.Host
+	useProxy := s.IsUseProxy(address)
+	err = s.OutToTCP(useProxy, address, outbound, authUser, &inConn, &req)
+	if err != nil {
+		if !useProxy {
+			log.Printf("connect to %s fail, err: %s", address, err)
+		} else {
+			log.Printf("connect to %s parent %s fail, err: %s", *s.cfg.ParentType, *s.cfg.Parent, err)
+		}
+		utils.CloseConn(&inConn)
+	}
+}
+func (s *SOCKS) IsUseProxy(address string) (useProxy bool) {
+	if *s.cfg.Parent == "" {
+		return false
+	}
+	if *s.cfg.Always {
+		return true
+	}
+	s.checker.Add(address, true, "CONNECT", "", nil)
+	useProxy, _, _ = s.checker.IsBlocked(address)
+	return
+}
+func (s *SOCKS) OutToTCP(useProxy bool, address, outbound, user string, inConn *net.Conn, req *utils.SOCKSRequest) (err error) {
+	inAddr := (*inConn).RemoteAddr().String()
+	inLocalAddr := (*inConn).LocalAddr().String()
+	if s.IsDeadLoop(inLocalAddr, address) {
+		req.Reply(utils.SOCKS5RepNotAllowed, nil)
+		err = fmt.Errorf("dead loop detected , %s", address)
+		return
+	}
+	var outConn net.Conn
+	if useProxy {
+		clientIP, _, _ := net.SplitHostPort(inAddr)
+		outConn, _, err = s.parents.Get(clientIP, func(conn net.Conn) (net.Conn, error) {
+			conn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+			parentUser, parentPass := s.ParentAuth()
+			err := utils.SOCKS5Connect(conn, address, parentUser, parentPass)
+			conn.SetDeadline(time.Time{})
+			return conn, err
+		})
+	} else {
+		var laddr string
+		if outbound != "" {
+			if laddr = s.mapping.Get(outbound); laddr == "" {
+				req.Reply(utils.SOCKS5RepNotAllowed, nil)
+				return fmt.Errorf("no mapping for outbound: %s", outbound)
+			}
+		}
+		if laddr != "" {
+			timeout := time.Duration(*s.cfg.Timeout) * time.Millisecond
+			outConn, err = utils.ConnectHostWithLAddr(address, laddr+":0", timeout)
+		} else {
+			outConn, err = utils.ConnectHost(address, *s.cfg.Timeout)
+		}
+	}
+	if err != nil {
+		req.Reply(socksRep(err), nil)
+		return
+	}
+
+	outAddr := outConn.RemoteAddr().String()
+	outLocalAddr := outConn.LocalAddr().String()
+	if useProxy {
+		err = req.Reply(utils.SOCKS5RepSuccess, nil)
+	} else {
+		err = req.Reply(utils.SOCKS5RepSuccess, outConn.LocalAddr())
+	}
+	if err != nil {
+		utils.CloseConn(&outConn)
+		return
+	}
+	download, upload := s.Limiters(user)
+	utils.IoBindLimit(*inConn, outConn, func(isSrcErr bool, err error) {
+		log.Printf("conn %s - %s - %s - %s released [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
+		utils.CloseConn(inConn)
+		utils.CloseConn(&outConn)
+	}, func(n int, d bool) {}, download, upload)
+	log.Printf("conn %s - %s - %s - %s connected [%s]", inAddr, inLocalAddr, outLocalAddr, outAddr, address)
+	return
+}
+
+// socksRep maps a dial error to the closest socks5 reply code.
+func socksRep(err error) uint8 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return utils.SOCKS5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return utils.SOCKS5RepNetworkUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return utils.SOCKS5RepTTLExpired
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return utils.SOCKS5RepHostUnreachable
+	}
+	return utils.SOCKS5RepGeneralFailure
+}
+func (s *SOCKS) InitOutConnPool() {
+	var newPool func(address string) utils.OutPool
+	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP {
+		newPool = func(address string) utils.OutPool {
+			//dur int, isTLS bool, certBytes, keyBytes []byte,
+			//parent string, timeout int, InitialCap int, MaxCap int
+			return utils.NewOutPool(
+				0,
+				*s.cfg.ParentType == TYPE_TLS,
+				s.cfg.CertBytes, s.cfg.KeyBytes,
+				address,
+				*s.cfg.Timeout,
+				*s.cfg.PoolSize,
+				*s.cfg.PoolSize*2,
+			)
+		}
+	}
+	var err error
+	// the parent group checks the parents, so the pools do not
+	s.parents, err = utils.NewParentGroup(*s.cfg.Parent, *s.cfg.LBMethod, *s.cfg.CheckParentInterval, *s.cfg.Timeout, newPool)
+	if err != nil {
+		log.Fatalf("parent ERR:%s", err)
+	}
+}
+func (s *SOCKS) ParentAuth() (user, pass string) {
+	return splitUserPass(*s.cfg.ParentAuth)
+}
+func (s *SOCKS) IsDeadLoop(inLocalAddr string, host string) bool {
+	return isDeadLoop(inLocalAddr, host, s.mapping)
+}
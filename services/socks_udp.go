@@ -0,0 +1,349 @@
+package services
+
+import (
+	"fmt"
+	"github.com/c3b2a7/goproxy/common/signal/done"
+	"github.com/c3b2a7/goproxy/utils"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpAssociation relays the datagrams of one UDP ASSOCIATE request. Every
+// remote peer gets a session, which is dropped after being idle for timeout,
+// the association itself ends when it has been idle for timeout.
+type udpAssociation struct {
+	timeout    time.Duration
+	sessions   utils.ConcurrentMap // remote address -> *udpSession
+	reply      func(srcAddr string, data []byte) error
+	parent     net.Conn
+	parentLock sync.Mutex
+	lastActive int64
+	done       *done.Instance
+	download   utils.Limiters
+	upload     utils.Limiters
+}
+
+// udpSession is a remote peer of an association, conn is nil when the
+// datagrams are relayed over the parent.
+type udpSession struct {
+	conn       *net.UDPConn
+	lastActive int64
+}
+
+func newUDPAssociation(timeout time.Duration, reply func(srcAddr string, data []byte) error) *udpAssociation {
+	a := &udpAssociation{
+		timeout:    timeout,
+		sessions:   utils.NewConcurrentMap(),
+		reply:      reply,
+		lastActive: time.Now().UnixNano(),
+		done:       done.New(),
+	}
+	go a.sweep()
+	return a
+}
+
+// SetParent relays all datagrams over parent, which has been set to udp over
+// tcp mode already.
+func (a *udpAssociation) SetParent(parent net.Conn) {
+	a.parent = parent
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("udp association parent reader crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+			}
+		}()
+		for {
+			srcAddr, data, err := utils.ReadUDPPacket(&parent)
+			if err != nil {
+				if err != io.EOF && !a.done.IsDone() {
+					log.Printf("read udp packet from parent fail, err: %s", err)
+				}
+				a.Close()
+				return
+			}
+			if _session, ok := a.sessions.Get(srcAddr); ok {
+				a.touch(_session.(*udpSession))
+				a.sendReply(srcAddr, data)
+			}
+		}
+	}()
+}
+
+// Send relays data to dstAddr, a session is created for a new peer.
+func (a *udpAssociation) Send(dstAddr string, data []byte) (err error) {
+	if a.done.IsDone() {
+		return fmt.Errorf("udp association closed")
+	}
+	_session, ok := a.sessions.Get(dstAddr)
+	if !ok {
+		_session, err = a.newSession(dstAddr)
+		if err != nil {
+			return
+		}
+	}
+	session := _session.(*udpSession)
+	a.touch(session)
+	a.upload.Wait(len(data))
+	if a.parent != nil {
+		a.parentLock.Lock()
+		_, err = a.parent.Write(utils.UDPPacket(dstAddr, data))
+		a.parentLock.Unlock()
+		return
+	}
+	_, err = session.conn.Write(data)
+	return
+}
+
+func (a *udpAssociation) sendReply(srcAddr string, data []byte) error {
+	a.download.Wait(len(data))
+	return a.reply(srcAddr, data)
+}
+
+func (a *udpAssociation) newSession(dstAddr string) (_session interface{}, err error) {
+	session := &udpSession{}
+	if a.parent == nil {
+		var addr *net.UDPAddr
+		addr, err = net.ResolveUDPAddr("udp", dstAddr)
+		if err != nil {
+			return
+		}
+		session.conn, err = net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return
+		}
+	}
+	if !a.sessions.SetIfAbsent(dstAddr, session) {
+		if session.conn != nil {
+			session.conn.Close()
+		}
+		_session, _ = a.sessions.Get(dstAddr)
+		return
+	}
+	if session.conn != nil {
+		go a.readSession(dstAddr, session)
+	}
+	return session, nil
+}
+
+func (a *udpAssociation) readSession(dstAddr string, session *udpSession) {
+	defer func() {
+		if e := recover(); e != nil {
+			log.Printf("udp session reader crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+		}
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, err := session.conn.Read(buf)
+		if err != nil {
+			a.sessions.Remove(dstAddr)
+			session.conn.Close()
+			return
+		}
+		a.touch(session)
+		if err = a.sendReply(dstAddr, buf[:n]); err != nil {
+			log.Printf("udp reply from %s fail, err: %s", dstAddr, err)
+		}
+	}
+}
+
+func (a *udpAssociation) touch(session *udpSession) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&session.lastActive, now)
+	atomic.StoreInt64(&a.lastActive, now)
+}
+
+func (a *udpAssociation) sweep() {
+	ticker := time.NewTicker(a.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.done.Wait():
+			return
+		case <-ticker.C:
+		}
+		deadline := time.Now().Add(-a.timeout).UnixNano()
+		for dstAddr, v := range a.sessions.Items() {
+			session := v.(*udpSession)
+			if atomic.LoadInt64(&session.lastActive) < deadline {
+				a.sessions.Remove(dstAddr)
+				if session.conn != nil {
+					session.conn.Close()
+				}
+			}
+		}
+		if atomic.LoadInt64(&a.lastActive) < deadline {
+			a.Close()
+		}
+	}
+}
+
+func (a *udpAssociation) Close() {
+	if a.done.IsDone() {
+		return
+	}
+	a.done.Done()
+	for dstAddr, v := range a.sessions.Items() {
+		a.sessions.Remove(dstAddr)
+		if session := v.(*udpSession); session.conn != nil {
+			session.conn.Close()
+		}
+	}
+	if a.parent != nil {
+		utils.CloseConn(&a.parent)
+	}
+}
+
+// UDPAssociate serves the UDP ASSOCIATE command, datagrams from the client
+// are accepted on a new udp port as long as inConn stays open. They count to
+// the limits of user like its tcp conns.
+func (s *SOCKS) UDPAssociate(user string, inConn *net.Conn, req *utils.SOCKSRequest) (err error) {
+	clientIP := (*inConn).RemoteAddr().(*net.TCPAddr).IP
+	localIP := (*inConn).LocalAddr().(*net.TCPAddr).IP
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		req.Reply(utils.SOCKS5RepGeneralFailure, nil)
+		return
+	}
+	var clientAddr atomic.Value
+	assoc := newUDPAssociation(time.Duration(*s.cfg.UDPTimeout)*time.Second, func(srcAddr string, data []byte) (err error) {
+		addr, _ := clientAddr.Load().(*net.UDPAddr)
+		if addr == nil {
+			return fmt.Errorf("client udp address unknown")
+		}
+		packet, err := utils.SOCKS5UDP(srcAddr, data)
+		if err != nil {
+			return
+		}
+		_, err = relay.WriteToUDP(packet, addr)
+		return
+	})
+	assoc.download, assoc.upload = s.Limiters(user)
+	if *s.cfg.Parent != "" {
+		var parent net.Conn
+		parent, err = s.GetUDPParentConn((*inConn).RemoteAddr())
+		if err != nil {
+			relay.Close()
+			assoc.Close()
+			req.Reply(utils.SOCKS5RepGeneralFailure, nil)
+			return
+		}
+		assoc.SetParent(parent)
+	}
+	if err = req.Reply(utils.SOCKS5RepSuccess, relay.LocalAddr()); err != nil {
+		relay.Close()
+		assoc.Close()
+		return
+	}
+	log.Printf("udp associate %s - %s created", (*inConn).RemoteAddr(), relay.LocalAddr())
+	go func() {
+		io.Copy(io.Discard, *inConn)
+		assoc.Close()
+	}()
+	go func() {
+		<-assoc.done.Wait()
+		relay.Close()
+		utils.CloseConn(inConn)
+		log.Printf("udp associate %s - %s released", (*inConn).RemoteAddr(), relay.LocalAddr())
+	}()
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("udp associate relay crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+			}
+		}()
+		buf := make([]byte, 65535)
+		for {
+			n, srcAddr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				assoc.Close()
+				return
+			}
+			if !srcAddr.IP.Equal(clientIP) {
+				continue
+			}
+			if addr, _ := clientAddr.Load().(*net.UDPAddr); addr == nil {
+				clientAddr.Store(srcAddr)
+			} else if addr.Port != srcAddr.Port {
+				continue
+			}
+			dstAddr, data, err := utils.ParseSOCKS5UDP(buf[:n])
+			if err != nil {
+				log.Printf("udp associate packet from %s dropped, err: %s", srcAddr, err)
+				continue
+			}
+			if err = assoc.Send(dstAddr, data); err != nil {
+				log.Printf("udp associate send to %s fail, err: %s", dstAddr, err)
+			}
+		}
+	}()
+	return
+}
+
+// UDPOverTCP serves a child goproxy which relays the datagrams of its
+// associations as UDPPacket frames over inConn, with the limits of user.
+func (s *SOCKS) UDPOverTCP(user string, inConn *net.Conn, req *utils.SOCKSRequest) (err error) {
+	var writeLock sync.Mutex
+	assoc := newUDPAssociation(time.Duration(*s.cfg.UDPTimeout)*time.Second, func(srcAddr string, data []byte) (err error) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		_, err = (*inConn).Write(utils.UDPPacket(srcAddr, data))
+		return
+	})
+	assoc.download, assoc.upload = s.Limiters(user)
+	if *s.cfg.Parent != "" {
+		var parent net.Conn
+		parent, err = s.GetUDPParentConn((*inConn).RemoteAddr())
+		if err != nil {
+			assoc.Close()
+			req.Reply(utils.SOCKS5RepGeneralFailure, nil)
+			return
+		}
+		assoc.SetParent(parent)
+	}
+	if err = req.Reply(utils.SOCKS5RepSuccess, nil); err != nil {
+		assoc.Close()
+		return
+	}
+	log.Printf("udp over tcp %s created", (*inConn).RemoteAddr())
+	go func() {
+		<-assoc.done.Wait()
+		utils.CloseConn(inConn)
+		log.Printf("udp over tcp %s released", (*inConn).RemoteAddr())
+	}()
+	go func() {
+		defer func() {
+			if e := recover(); e != nil {
+				log.Printf("udp over tcp reader crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+			}
+		}()
+		for {
+			dstAddr, data, err := utils.ReadUDPPacket(inConn)
+			if err != nil {
+				assoc.Close()
+				return
+			}
+			if err = assoc.Send(dstAddr, data); err != nil {
+				log.Printf("udp over tcp send to %s fail, err: %s", dstAddr, err)
+			}
+		}
+	}()
+	return
+}
+
+// GetUDPParentConn returns a parent conn switched to udp over tcp mode.
+func (s *SOCKS) GetUDPParentConn(client net.Addr) (conn net.Conn, err error) {
+	clientIP, _, _ := net.SplitHostPort(client.String())
+	conn, _, err = s.parents.Get(clientIP, func(conn net.Conn) (net.Conn, error) {
+		conn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+		parentUser, parentPass := s.ParentAuth()
+		_, err := utils.SOCKS5Handshake(conn, utils.SOCKS5CmdUDPOverTCP, "0.0.0.0:0", parentUser, parentPass)
+		conn.SetDeadline(time.Time{})
+		return conn, err
+	})
+	return
+}
@@ -13,22 +13,21 @@ import (
 )
 
 type TCP struct {
-	outPool utils.OutPool
+	parents *utils.ParentGroup
 	cfg     TCPArgs
 }
 
 func NewTCP() Service {
 	return &TCP{
-		outPool: utils.OutPool{},
-		cfg:     TCPArgs{},
+		cfg: TCPArgs{},
 	}
 }
 func (s *TCP) InitService() {
 	s.InitOutConnPool()
 }
 func (s *TCP) StopService() {
-	if s.outPool.Pool != nil {
-		s.outPool.Pool.ReleaseAll()
+	if s.parents != nil {
+		s.parents.ReleaseAll()
 	}
 }
 func (s *TCP) Start(args interface{}) (err error) {
@@ -38,12 +37,17 @@ func (s *TCP) Start(args interface{}) (err error) {
 	} else {
 		log.Fatalf("parent required for %s %s", s.cfg.Protocol(), *s.cfg.Local)
 	}
+	if (s.IsHTTPParent() || *s.cfg.ParentType == TYPE_SOCKS5) && *s.cfg.Target == "" {
+		log.Fatalf("target required for %s parent", *s.cfg.ParentType)
+	}
 
 	s.InitService()
 
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetIPFilter(s.cfg.IPFilter)
+	sc.SetQuota(s.cfg.IPQuota, nil)
 	if !*s.cfg.IsTLS {
 		err = sc.ListenTCP(s.callback)
 	} else {
@@ -67,9 +71,7 @@ func (s *TCP) callback(inConn net.Conn) {
 	}()
 	var err error
 	switch *s.cfg.ParentType {
-	case TYPE_TCP:
-		fallthrough
-	case TYPE_TLS:
+	case TYPE_TCP, TYPE_TLS, TYPE_HTTP, TYPE_HTTPS, TYPE_SOCKS5:
 		err = s.OutToTCP(&inConn)
 	case TYPE_UDP:
 		err = s.OutToUDP(&inConn)
@@ -82,12 +84,8 @@ func (s *TCP) callback(inConn net.Conn) {
 	}
 }
 func (s *TCP) OutToTCP(inConn *net.Conn) (err error) {
-	var outConn net.Conn
-	var _outConn interface{}
-	_outConn, err = s.outPool.Pool.Get()
-	if err == nil {
-		outConn = _outConn.(net.Conn)
-	}
+	clientIP, _, _ := net.SplitHostPort((*inConn).RemoteAddr().String())
+	outConn, _, err := s.parents.Get(clientIP, s.handshake())
 	if err != nil {
 		log.Printf("connect to %s , err:%s", *s.cfg.Parent, err)
 		utils.CloseConn(inConn)
@@ -97,16 +95,36 @@ func (s *TCP) OutToTCP(inConn *net.Conn) (err error) {
 	inLocalAddr := (*inConn).LocalAddr().String()
 	outAddr := outConn.RemoteAddr().String()
 	outLocalAddr := outConn.LocalAddr().String()
-	utils.IoBind((*inConn), outConn, func(isSrcErr bool, err error) {
+	utils.IoBindLimit((*inConn), outConn, func(isSrcErr bool, err error) {
 		log.Printf("conn %s - %s - %s -%s released", inAddr, inLocalAddr, outLocalAddr, outAddr)
 		utils.CloseConn(inConn)
 		utils.CloseConn(&outConn)
-	}, func(n int, d bool) {}, 0)
+	}, func(n int, d bool) {}, s.cfg.Download, s.cfg.Upload)
 	log.Printf("conn %s - %s - %s -%s connected", inAddr, inLocalAddr, outLocalAddr, outAddr)
 	return
 }
+
+// handshake returns the handshake which asks a http or socks5 parent for a
+// tunnel to the target, nil for other parents.
+func (s *TCP) handshake() func(conn net.Conn) (net.Conn, error) {
+	if !s.IsHTTPParent() && *s.cfg.ParentType != TYPE_SOCKS5 {
+		return nil
+	}
+	return func(conn net.Conn) (tunnel net.Conn, err error) {
+		conn.SetDeadline(time.Now().Add(time.Duration(*s.cfg.Timeout) * time.Millisecond))
+		user, pass := splitUserPass(*s.cfg.ParentAuth)
+		if s.IsHTTPParent() {
+			tunnel, err = utils.HTTPConnect(conn, *s.cfg.Target, user, pass)
+		} else {
+			tunnel, err = conn, utils.SOCKS5Connect(conn, *s.cfg.Target, user, pass)
+		}
+		conn.SetDeadline(time.Time{})
+		return
+	}
+}
 func (s *TCP) OutToUDP(inConn *net.Conn) (err error) {
 	log.Printf("conn created , remote : %s ", (*inConn).RemoteAddr())
+	clientIP, _, _ := net.SplitHostPort((*inConn).RemoteAddr().String())
 	for {
 		srcAddr, body, err := utils.ReadUDPPacket(inConn)
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
@@ -115,33 +133,23 @@ func (s *TCP) OutToUDP(inConn *net.Conn) (err error) {
 			break
 		}
 		//log.Debugf("udp packet revecived:%s,%v", srcAddr, body)
-		dstAddr, err := net.ResolveUDPAddr("udp", *s.cfg.Parent)
-		if err != nil {
-			log.Printf("can't resolve address: %s", err)
-			utils.CloseConn(inConn)
-			break
-		}
-		clientSrcAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
-		conn, err := net.DialUDP("udp", clientSrcAddr, dstAddr)
-		if err != nil {
-			log.Printf("connect to udp %s fail,ERR:%s", dstAddr.String(), err)
-			continue
-		}
-		conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(*s.cfg.Timeout)))
-		_, err = conn.Write(body)
+		s.cfg.Upload.Wait(len(body))
+		conn, err := s.parents.SendUDP(body, clientIP, *s.cfg.Timeout)
 		if err != nil {
-			log.Printf("send udp packet to %s fail,ERR:%s", dstAddr.String(), err)
 			continue
 		}
+		dstAddr := conn.RemoteAddr()
 		//log.Debugf("send udp packet to %s success", dstAddr.String())
 		buf := make([]byte, 512)
 		len, _, err := conn.ReadFromUDP(buf)
+		conn.Close()
 		if err != nil {
 			log.Printf("read udp response from %s fail ,ERR:%s", dstAddr.String(), err)
 			continue
 		}
 		respBody := buf[0:len]
 		//log.Debugf("revecived udp packet from %s , %v", dstAddr.String(), respBody)
+		s.cfg.Download.Wait(len)
 		_, err = (*inConn).Write(utils.UDPPacket(srcAddr, respBody))
 		if err != nil {
 			log.Printf("send udp response fail ,ERR:%s", err)
@@ -153,18 +161,49 @@ func (s *TCP) OutToUDP(inConn *net.Conn) (err error) {
 	return
 
 }
+
 func (s *TCP) InitOutConnPool() {
-	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP {
-		//dur int, isTLS bool, certBytes, keyBytes []byte,
-		//parent string, timeout int, InitialCap int, MaxCap int
-		s.outPool = utils.NewOutPool(
-			*s.cfg.CheckParentInterval,
-			*s.cfg.ParentType == TYPE_TLS,
-			s.cfg.CertBytes, s.cfg.KeyBytes,
-			*s.cfg.Parent,
-			*s.cfg.Timeout,
-			*s.cfg.PoolSize,
-			*s.cfg.PoolSize*2,
-		)
+	var newPool func(address string) utils.OutPool
+	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP || *s.cfg.ParentType == TYPE_SOCKS5 || s.IsHTTPParent() {
+		certBytes, keyBytes := s.cfg.CertBytes, s.cfg.KeyBytes
+		if s.IsHTTPParent() {
+			// a standard https parent does not know our cert
+			certBytes, keyBytes = nil, nil
+		}
+		newPool = func(address string) utils.OutPool {
+			//dur int, isTLS bool, certBytes, keyBytes []byte,
+			//parent string, timeout int, InitialCap int, MaxCap int
+			return utils.NewOutPool(
+				0,
+				*s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_HTTPS,
+				certBytes, keyBytes,
+				address,
+				*s.cfg.Timeout,
+				s.poolSize(),
+				s.poolSize()*2,
+			)
+		}
 	}
+	var err error
+	// the parent group checks the parents, so the pools do not
+	s.parents, err = utils.NewParentGroup(*s.cfg.Parent, *s.cfg.LBMethod, *s.cfg.CheckParentInterval, *s.cfg.Timeout, newPool)
+	if err != nil {
+		log.Fatalf("parent ERR:%s", err)
+	}
+}
+
+// poolSize returns the number of conns dialed ahead to each parent. A socks5
+// or http parent drops conns which do not negotiate or send a request in
+// time, they are dialed when needed.
+func (s *TCP) poolSize() int {
+	if *s.cfg.ParentType == TYPE_SOCKS5 || s.IsHTTPParent() {
+		return 0
+	}
+	return *s.cfg.PoolSize
+}
+
+// IsHTTPParent reports whether the parent is a standard http proxy, which is
+// asked to connect to the target.
+func (s *TCP) IsHTTPParent() bool {
+	return *s.cfg.ParentType == TYPE_HTTP || *s.cfg.ParentType == TYPE_HTTPS
 }
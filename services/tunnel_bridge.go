@@ -50,6 +50,8 @@ func (s *TunnelBridge) Start(args interface{}) (err error) {
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetIPFilter(s.cfg.IPFilter)
+	sc.SetQuota(s.cfg.IPQuota, nil)
 
 	err = sc.ListenTls(s.cfg.CertBytes, s.cfg.KeyBytes, func(inConn net.Conn) {
 		reader := bufio.NewReader(inConn)
@@ -172,11 +174,11 @@ func (s *TunnelBridge) ChnDeamon(item *BridgeItem) {
 				}
 			}
 
-			utils.IoBind(*serverConn, *clientConn, func(isSrcErr bool, err error) {
+			utils.IoBindLimit(*serverConn, *clientConn, func(isSrcErr bool, err error) {
 				utils.CloseConn(serverConn)
 				utils.CloseConn(clientConn)
 				log.Printf("%s conn %s - %s - %s - %s released", item.Key, (*serverConn).RemoteAddr(), (*serverConn).LocalAddr(), (*clientConn).LocalAddr(), (*clientConn).RemoteAddr())
-			}, func(i int, b bool) {}, 0)
+			}, func(i int, b bool) {}, s.cfg.Download, s.cfg.Upload)
 			log.Printf("%s conn %s - %s - %s - %s created", item.Key, (*serverConn).RemoteAddr(), (*serverConn).LocalAddr(), (*clientConn).LocalAddr(), (*clientConn).RemoteAddr())
 		}
 	}()
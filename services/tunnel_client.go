@@ -147,6 +147,7 @@ func (s *TunnelClient) processUDPPacket(inConn *net.Conn, srcAddr string, body [
 		return
 	}
 	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(*s.cfg.Timeout)))
+	s.cfg.Upload.Wait(len(body))
 	_, err = conn.Write(body)
 	if err != nil {
 		log.Printf("send udp packet to %s fail,ERR:%s", dstAddr.String(), err)
@@ -161,6 +162,7 @@ func (s *TunnelClient) processUDPPacket(inConn *net.Conn, srcAddr string, body [
 	}
 	respBody := buf[0:len]
 	//log.Printf("revecived udp packet from %s , %v", dstAddr.String(), respBody)
+	s.cfg.Download.Wait(len)
 	_, err = (*inConn).Write(utils.UDPPacket(srcAddr, respBody))
 	if err != nil {
 		log.Printf("send udp response fail ,ERR:%s", err)
@@ -206,10 +208,10 @@ func (s *TunnelClient) ServeConn() {
 		return
 	}
 
-	utils.IoBind(inConn, outConn, func(isSrcErr bool, err error) {
+	utils.IoBindLimit(inConn, outConn, func(isSrcErr bool, err error) {
 		log.Printf("%s conn %s - %s - %s - %s released", *s.cfg.Key, inConn.RemoteAddr(), inConn.LocalAddr(), outConn.LocalAddr(), outConn.RemoteAddr())
 		utils.CloseConn(&inConn)
 		utils.CloseConn(&outConn)
-	}, func(i int, b bool) {}, 0)
+	}, func(i int, b bool) {}, s.cfg.Download, s.cfg.Upload)
 	log.Printf("%s conn %s - %s - %s - %s created", *s.cfg.Key, inConn.RemoteAddr(), inConn.LocalAddr(), outConn.LocalAddr(), outConn.RemoteAddr())
 }
@@ -56,6 +56,8 @@ func (s *TunnelServer) Start(args interface{}) (err error) {
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	s.sc = utils.NewServerChannel(host, p)
+	s.sc.SetIPFilter(s.cfg.IPFilter)
+	s.sc.SetQuota(s.cfg.IPQuota, nil)
 
 	if *s.cfg.IsUDP {
 		err = s.sc.ListenUDP(func(packet []byte, localAddr, srcAddr *net.UDPAddr) {
@@ -89,11 +91,11 @@ func (s *TunnelServer) Start(args interface{}) (err error) {
 				}
 			}
 
-			utils.IoBind(inConn, outConn, func(isSrcErr bool, err error) {
+			utils.IoBindLimit(inConn, outConn, func(isSrcErr bool, err error) {
 				utils.CloseConn(&outConn)
 				utils.CloseConn(&inConn)
 				log.Printf("%s conn %s - %s - %s - %s released", *s.cfg.Key, inConn.RemoteAddr(), inConn.LocalAddr(), outConn.LocalAddr(), outConn.RemoteAddr())
-			}, func(i int, b bool) {}, 0)
+			}, func(i int, b bool) {}, s.cfg.Download, s.cfg.Upload)
 
 			log.Printf("%s conn %s - %s - %s - %s created", *s.cfg.Key, inConn.RemoteAddr(), inConn.LocalAddr(), outConn.LocalAddr(), outConn.RemoteAddr())
 		})
@@ -183,6 +185,7 @@ func (s *TunnelServer) UDPConnDeamon() {
 								}
 								port, _ := strconv.Atoi(_srcAddr[1])
 								dstAddr := &net.UDPAddr{IP: net.ParseIP(_srcAddr[0]), Port: port}
+								s.cfg.Download.Wait(len(body))
 								_, err = s.sc.UDPListener.WriteToUDP(body, dstAddr)
 								if err != nil {
 									log.Printf("udp response to local %s fail,ERR:%s", srcAddrFromConn, err)
@@ -195,6 +198,7 @@ func (s *TunnelServer) UDPConnDeamon() {
 					}
 				}
 			}
+			s.cfg.Upload.Wait(len(*item.packet))
 			writer := bufio.NewWriter(outConn)
 			writer.Write(utils.UDPPacket(item.srcAddr.String(), *item.packet))
 			err := writer.Flush()
@@ -11,30 +11,26 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"time"
 )
 
 type UDP struct {
 	p       utils.ConcurrentMap
-	outPool utils.OutPool
+	parents *utils.ParentGroup
 	cfg     UDPArgs
 	sc      *utils.ServerChannel
 }
 
 func NewUDP() Service {
 	return &UDP{
-		outPool: utils.OutPool{},
-		p:       utils.NewConcurrentMap(),
+		p: utils.NewConcurrentMap(),
 	}
 }
 func (s *UDP) InitService() {
-	if *s.cfg.ParentType != TYPE_UDP {
-		s.InitOutConnPool()
-	}
+	s.InitOutConnPool()
 }
 func (s *UDP) StopService() {
-	if s.outPool.Pool != nil {
-		s.outPool.Pool.ReleaseAll()
+	if s.parents != nil {
+		s.parents.ReleaseAll()
 	}
 }
 func (s *UDP) Start(args interface{}) (err error) {
@@ -50,6 +46,7 @@ func (s *UDP) Start(args interface{}) (err error) {
 	host, port, _ := net.SplitHostPort(*s.cfg.Local)
 	p, _ := strconv.Atoi(port)
 	sc := utils.NewServerChannel(host, p)
+	sc.SetIPFilter(s.cfg.IPFilter)
 	s.sc = &sc
 	err = sc.ListenUDP(s.callback)
 	if err != nil {
@@ -83,11 +80,14 @@ func (s *UDP) callback(packet []byte, localAddr, srcAddr *net.UDPAddr) {
 		log.Printf("connect to %s parent %s fail, ERR:%s", *s.cfg.ParentType, *s.cfg.Parent, err)
 	}
 }
-func (s *UDP) GetConn(connKey string) (conn net.Conn, isNew bool, err error) {
+
+// GetConn returns the parent conn of connKey, a new one is taken from the
+// parent selected for clientIP.
+func (s *UDP) GetConn(connKey, clientIP string) (conn net.Conn, isNew bool, err error) {
 	isNew = !s.p.Has(connKey)
 	var _conn interface{}
 	if isNew {
-		_conn, err = s.outPool.Pool.Get()
+		_conn, _, err = s.parents.Get(clientIP, nil)
 		if err != nil {
 			return nil, false, err
 		}
@@ -106,7 +106,7 @@ func (s *UDP) OutToTCP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 		mod = 10
 	}
 	connKey := uint64((numLocal/10)*10 + numSrc%mod)
-	conn, isNew, err := s.GetConn(fmt.Sprintf("%d", connKey))
+	conn, isNew, err := s.GetConn(fmt.Sprintf("%d", connKey), srcAddr.IP.String())
 	if err != nil {
 		log.Printf("upd get conn to %s parent %s fail, ERR:%s", *s.cfg.ParentType, *s.cfg.Parent, err)
 		return
@@ -138,6 +138,7 @@ func (s *UDP) OutToTCP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 				}
 				port, _ := strconv.Atoi(_srcAddr[1])
 				dstAddr := &net.UDPAddr{IP: net.ParseIP(_srcAddr[0]), Port: port}
+				s.cfg.Download.Wait(len(body))
 				_, err = s.sc.UDPListener.WriteToUDP(body, dstAddr)
 				if err != nil {
 					log.Printf("udp response to local %s fail,ERR:%s", srcAddr, err)
@@ -148,6 +149,7 @@ func (s *UDP) OutToTCP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 		}()
 	}
 	//log.Printf("select conn %d , local: %s", connKey, srcAddr.String())
+	s.cfg.Upload.Wait(len(packet))
 	writer := bufio.NewWriter(conn)
 	//fmt.Println(conn, writer)
 	writer.Write(utils.UDPPacket(srcAddr.String(), packet))
@@ -161,23 +163,13 @@ func (s *UDP) OutToTCP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 }
 func (s *UDP) OutToUDP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err error) {
 	//log.Printf("udp packet revecived:%s,%v", srcAddr, packet)
-	dstAddr, err := net.ResolveUDPAddr("udp", *s.cfg.Parent)
+	s.cfg.Upload.Wait(len(packet))
+	conn, err := s.parents.SendUDP(packet, srcAddr.IP.String(), *s.cfg.Timeout)
 	if err != nil {
-		log.Printf("resolve udp addr %s fail  fail,ERR:%s", dstAddr.String(), err)
-		return
-	}
-	clientSrcAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
-	conn, err := net.DialUDP("udp", clientSrcAddr, dstAddr)
-	if err != nil {
-		log.Printf("connect to udp %s fail,ERR:%s", dstAddr.String(), err)
-		return
-	}
-	conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(*s.cfg.Timeout)))
-	_, err = conn.Write(packet)
-	if err != nil {
-		log.Printf("send udp packet to %s fail,ERR:%s", dstAddr.String(), err)
 		return
 	}
+	defer conn.Close()
+	dstAddr := conn.RemoteAddr()
 	//log.Printf("send udp packet to %s success", dstAddr.String())
 	buf := make([]byte, 512)
 	len, _, err := conn.ReadFromUDP(buf)
@@ -186,6 +178,7 @@ func (s *UDP) OutToUDP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 		return
 	}
 	//log.Printf("revecived udp packet from %s , %v", dstAddr.String(), respBody)
+	s.cfg.Download.Wait(len)
 	_, err = s.sc.UDPListener.WriteToUDP(buf[0:len], srcAddr)
 	if err != nil {
 		log.Printf("send udp response to cluster fail ,ERR:%s", err)
@@ -194,18 +187,28 @@ func (s *UDP) OutToUDP(packet []byte, localAddr, srcAddr *net.UDPAddr) (err erro
 	//log.Printf("send udp response to cluster success ,from:%s", dstAddr.String())
 	return
 }
+
 func (s *UDP) InitOutConnPool() {
+	var newPool func(address string) utils.OutPool
 	if *s.cfg.ParentType == TYPE_TLS || *s.cfg.ParentType == TYPE_TCP {
-		//dur int, isTLS bool, certBytes, keyBytes []byte,
-		//parent string, timeout int, InitialCap int, MaxCap int
-		s.outPool = utils.NewOutPool(
-			*s.cfg.CheckParentInterval,
-			*s.cfg.ParentType == TYPE_TLS,
-			s.cfg.CertBytes, s.cfg.KeyBytes,
-			*s.cfg.Parent,
-			*s.cfg.Timeout,
-			*s.cfg.PoolSize,
-			*s.cfg.PoolSize*2,
-		)
+		newPool = func(address string) utils.OutPool {
+			//dur int, isTLS bool, certBytes, keyBytes []byte,
+			//parent string, timeout int, InitialCap int, MaxCap int
+			return utils.NewOutPool(
+				0,
+				*s.cfg.ParentType == TYPE_TLS,
+				s.cfg.CertBytes, s.cfg.KeyBytes,
+				address,
+				*s.cfg.Timeout,
+				*s.cfg.PoolSize,
+				*s.cfg.PoolSize*2,
+			)
+		}
+	}
+	var err error
+	// the parent group checks the parents, so the pools do not
+	s.parents, err = utils.NewParentGroup(*s.cfg.Parent, *s.cfg.LBMethod, *s.cfg.CheckParentInterval, *s.cfg.Timeout, newPool)
+	if err != nil {
+		log.Fatalf("parent ERR:%s", err)
 	}
 }
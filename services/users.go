@@ -0,0 +1,115 @@
+package services
+
+import (
+	"fmt"
+	"github.com/c3b2a7/goproxy/utils"
+	"log"
+	"net"
+	"time"
+)
+
+// users authenticates the clients of the http and the socks service and
+// applies the limits of their users.
+type users struct {
+	userArgs    UserArgs
+	download    utils.Limiters
+	upload      utils.Limiters
+	basicAuth   utils.BasicAuth
+	authGuard   *utils.AuthGuard
+	userLimiter *utils.UserLimiter
+	userQuota   *utils.Quota
+}
+
+// InitUsers sets up the auth and the user limits of args, download and upload
+// are the limiters of the service, which apply to all users.
+func (u *users) InitUsers(args UserArgs, download, upload utils.Limiters) (err error) {
+	u.userArgs, u.download, u.upload = args, download, upload
+	if err = u.InitBasicAuth(); err != nil {
+		return
+	}
+	if len(*args.UserLimit) > 0 || *args.UserLimitFile != "" {
+		u.userLimiter, err = utils.NewUserLimiter(*args.UserLimit, *args.UserLimitFile, *args.UserLimitInterval)
+		if err != nil {
+			return fmt.Errorf("user-limit ERR:%s", err)
+		}
+	}
+	if u.IsBasicAuth() && *args.AuthMaxFails > 0 {
+		u.authGuard, err = utils.NewAuthGuard(*args.AuthMaxFails,
+			time.Duration(*args.AuthFailWindow)*time.Second,
+			time.Duration(*args.AuthBanTime)*time.Second,
+			time.Duration(*args.AuthMaxBanTime)*time.Second,
+			*args.AuthBanFile)
+		if err != nil {
+			return fmt.Errorf("auth-ban-file ERR:%s", err)
+		}
+	}
+	if *args.MaxConnsPerUser > 0 || *args.ConnRatePerUser > 0 {
+		u.userQuota = utils.NewQuota(*args.MaxConnsPerUser, *args.ConnRatePerUser)
+	}
+	return
+}
+
+func (u *users) InitBasicAuth() (err error) {
+	var chain utils.AuthChain
+	if *u.userArgs.AuthFile != "" || len(*u.userArgs.Auth) > 0 {
+		staticAuth := utils.NewStaticAuth()
+		if *u.userArgs.AuthFile != "" {
+			var n = 0
+			n, err = staticAuth.AddFromFile(*u.userArgs.AuthFile)
+			if err != nil {
+				err = fmt.Errorf("auth-file ERR:%s", err)
+				return
+			}
+			log.Printf("auth data added from file %d , total:%d", n, staticAuth.Total())
+		}
+		if len(*u.userArgs.Auth) > 0 {
+			n := staticAuth.Add(*u.userArgs.Auth)
+			log.Printf("auth data added %d, total:%d", n, staticAuth.Total())
+		}
+		chain = append(chain, staticAuth)
+	}
+	if *u.userArgs.AuthURL != "" {
+		chain = append(chain, utils.NewHTTPAuth(*u.userArgs.AuthURL, *u.userArgs.AuthTimeout, *u.userArgs.AuthCache))
+		log.Printf("auth by url %s", *u.userArgs.AuthURL)
+	}
+	if *u.userArgs.AuthCmd != "" {
+		chain = append(chain, utils.NewCommandAuth(*u.userArgs.AuthCmd, *u.userArgs.AuthTimeout, *u.userArgs.AuthCache))
+		log.Printf("auth by command %s", *u.userArgs.AuthCmd)
+	}
+	if len(chain) == 1 {
+		u.basicAuth = chain[0]
+	} else {
+		u.basicAuth = chain
+	}
+	return
+}
+func (u *users) IsBasicAuth() bool {
+	return *u.userArgs.AuthFile != "" || len(*u.userArgs.Auth) > 0 || *u.userArgs.AuthURL != "" || *u.userArgs.AuthCmd != ""
+}
+
+// Limiters returns the limiters of a conn of user, those of the service and
+// those of user. download limits the bytes from the target and upload those
+// from the client.
+func (u *users) Limiters(user string) (download, upload utils.Limiters) {
+	download = append(download, u.download...)
+	upload = append(upload, u.upload...)
+	if u.userLimiter == nil || user == "" {
+		return
+	}
+	up, down := u.userLimiter.Get(user)
+	return append(download, down), append(upload, up)
+}
+
+// AcquireUser takes a conn of user from the user quota, the slot is released
+// when inConn is closed.
+func (u *users) AcquireUser(inConn *net.Conn, user string) (err error) {
+	if u.userQuota == nil || user == "" {
+		return
+	}
+	release, err := u.userQuota.Acquire(user)
+	if err != nil {
+		return
+	}
+	*inConn = utils.NewReleaseConn(*inConn, release)
+	return
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ACL is a per-user destination policy loaded from a file, one entry each
+// line, "#" starts a comment:
+//
+//	group <name> <user> [user...]
+//	allow|deny <user|@group|*> <destination> [ports]
+//
+// destination is "*", an ip or CIDR, a domain suffix starting with "." (which
+// matches the domain itself too), a wildcard with "*" or "?", or a host. ports
+// is a comma separated list of ports and ranges, such as "80,443,8000-8100".
+// Rules are evaluated in order and the first matching one wins, a destination
+// matched by no rule is denied.
+type ACL struct {
+	rules  []aclRule
+	groups map[string]map[string]bool
+}
+
+type aclRule struct {
+	line    int
+	allow   bool
+	subject string
+	dest    string
+	ipNet   *net.IPNet
+	ports   [][2]int
+}
+
+func LoadACL(file string) (acl *ACL, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	return ParseACL(string(content))
+}
+
+func ParseACL(content string) (acl *ACL, err error) {
+	acl = &ACL{groups: map[string]map[string]bool{}}
+	for i, line := range strings.Split(content, "\n") {
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "group":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("acl line %d: group needs a name and users", i+1)
+			}
+			if acl.groups[fields[1]] == nil {
+				acl.groups[fields[1]] = map[string]bool{}
+			}
+			for _, user := range fields[2:] {
+				acl.groups[fields[1]][user] = true
+			}
+		case "allow", "deny":
+			if len(fields) < 3 || len(fields) > 4 {
+				return nil, fmt.Errorf("acl line %d: want %s <user|@group|*> <destination> [ports]", i+1, fields[0])
+			}
+			rule := aclRule{
+				line:    i + 1,
+				allow:   fields[0] == "allow",
+				subject: fields[1],
+				dest:    strings.ToLower(fields[2]),
+			}
+			if ipNet, e := ParseIPNet(rule.dest); e == nil {
+				rule.ipNet = ipNet
+			}
+			if len(fields) == 4 {
+				if rule.ports, err = parsePortRanges(fields[3]); err != nil {
+					return nil, fmt.Errorf("acl line %d: %s", i+1, err)
+				}
+			}
+			acl.rules = append(acl.rules, rule)
+		default:
+			return nil, fmt.Errorf("acl line %d: unknown directive %s", i+1, fields[0])
+		}
+	}
+	for _, rule := range acl.rules {
+		if strings.HasPrefix(rule.subject, "@") && acl.groups[rule.subject[1:]] == nil {
+			return nil, fmt.Errorf("acl line %d: unknown group %s", rule.line, rule.subject)
+		}
+	}
+	return
+}
+
+func parsePortRanges(s string) (ports [][2]int, err error) {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		var low, high int
+		if low, err = strconv.Atoi(bounds[0]); err != nil {
+			return nil, fmt.Errorf("invalid port %s", part)
+		}
+		high = low
+		if len(bounds) == 2 {
+			if high, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("invalid port range %s", part)
+			}
+		}
+		if low < 1 || high > 65535 || low > high {
+			return nil, fmt.Errorf("invalid port range %s", part)
+		}
+		ports = append(ports, [2]int{low, high})
+	}
+	return
+}
+
+// Check reports whether user may connect to address, which is "host:port".
+// user is "" for clients which did not authenticate, they only match "*"
+// rules. reason tells which rule denied the request.
+func (acl *ACL) Check(user, address string) (ok bool, reason string) {
+	return acl.check(user, address, nil)
+}
+
+// CheckDialed checks address again with ip, the one a conn to it was made
+// to, so a name resolving to other ips at dial time can not bypass CIDR rules.
+func (acl *ACL) CheckDialed(user, address string, ip net.IP) (ok bool, reason string) {
+	return acl.check(user, address, []net.IP{ip})
+}
+
+// check evaluates the rules for address, CIDR rules match ips, or the ips
+// the host resolves to if ips is nil.
+func (acl *ACL) check(user, address string, ips []net.IP) (ok bool, reason string) {
+	host, _port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false, "invalid destination " + address
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	port, _ := strconv.Atoi(_port)
+	resolved := ips != nil
+	for _, rule := range acl.rules {
+		if !acl.matchSubject(rule.subject, user) || !rule.matchPort(port) {
+			continue
+		}
+		if rule.ipNet != nil {
+			if !resolved {
+				// domains are resolved, so a CIDR rule can not be bypassed by name
+				if ip := net.ParseIP(host); ip != nil {
+					ips = []net.IP{ip}
+				} else {
+					ips, _ = net.LookupIP(host)
+				}
+				resolved = true
+			}
+			if len(ips) == 0 {
+				return false, fmt.Sprintf("access to %s denied, it can not be resolved for acl rule at line %d", address, rule.line)
+			}
+			if !containsAnyIP(rule.ipNet, ips) {
+				continue
+			}
+		} else if !rule.matchHost(host) {
+			continue
+		}
+		if rule.allow {
+			return true, ""
+		}
+		return false, fmt.Sprintf("access to %s denied by acl rule at line %d", address, rule.line)
+	}
+	return false, fmt.Sprintf("access to %s not allowed by any acl rule", address)
+}
+
+func (acl *ACL) matchSubject(subject, user string) bool {
+	switch {
+	case subject == "*":
+		return true
+	case user == "":
+		return false
+	case strings.HasPrefix(subject, "@"):
+		return acl.groups[subject[1:]][user]
+	}
+	return subject == user
+}
+
+func (rule *aclRule) matchPort(port int) bool {
+	if rule.ports == nil {
+		return true
+	}
+	for _, r := range rule.ports {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *aclRule) matchHost(host string) bool {
+	switch {
+	case rule.dest == "*":
+		return true
+	case strings.HasPrefix(rule.dest, "."):
+		return host == rule.dest[1:] || strings.HasSuffix(host, rule.dest)
+	case strings.ContainsAny(rule.dest, "*?["):
+		ok, _ := path.Match(rule.dest, host)
+		return ok
+	}
+	return host == rule.dest
+}
+
+func containsAnyIP(ipNet *net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
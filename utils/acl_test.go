@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl, err := ParseACL(`
+group contractors alice bob
+deny  @contractors db.corp.example.com
+allow @contractors .corp.example.com 443,8000-8100
+allow @contractors 10.1.0.0/16 22
+deny  @contractors *
+allow carol        git-?.example.com
+allow *            *                  80,443 # everyone else
+`)
+	assert.NoError(t, err)
+	tests := []struct {
+		user    string
+		address string
+		ok      bool
+	}{
+		{"alice", "wiki.corp.example.com:443", true},
+		{"alice", "corp.example.com:8080", true},
+		{"alice", "wiki.corp.example.com:80", false},
+		{"alice", "db.corp.example.com:443", false},
+		{"bob", "10.1.2.3:22", true},
+		{"bob", "10.2.0.1:22", false},
+		{"bob", "example.org:443", false},
+		{"carol", "git-1.example.com:22", true},
+		{"carol", "git-10.example.com:22", false},
+		{"carol", "example.org:443", true},
+		{"", "example.org:80", true},
+		{"", "example.org:22", false},
+	}
+	for _, test := range tests {
+		ok, reason := acl.Check(test.user, test.address)
+		assert.Equal(t, test.ok, ok, test.user+" "+test.address)
+		assert.Equal(t, test.ok, reason == "")
+	}
+
+	for _, content := range []string{"allow @nobody *", "allow * * 0-10", "permit * *", "allow *"} {
+		_, err = ParseACL(content)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestACLCheckResolve(t *testing.T) {
+	acl, err := ParseACL(`
+deny  * 10.0.0.0/8
+allow * *
+`)
+	assert.NoError(t, err)
+	ok, _ := acl.Check("", "unresolvable.invalid:80")
+	assert.False(t, ok)
+	ok, _ = acl.Check("", "8.8.8.8:80")
+	assert.True(t, ok)
+	// the ip dialled counts, not the one the name resolved to before
+	ok, _ = acl.CheckDialed("", "rebind.example.com:80", net.ParseIP("10.0.0.1"))
+	assert.False(t, ok)
+	ok, _ = acl.CheckDialed("", "rebind.example.com:80", net.ParseIP("8.8.8.8"))
+	assert.True(t, ok)
+}
@@ -0,0 +1,336 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthGuard counts auth failures of each client ip and each username, an ip
+// or a user failing maxFails times within the window is banned for banTime,
+// which doubles with every ban in a row up to maxBanTime. Banned clients are
+// rejected without checking their credentials.
+//
+// Failures are logged as
+//
+//	auth failure for user "<user>" from <ip>
+//
+// which fail2ban matches with: auth failure for user ".*" from <HOST>$
+//
+// Current bans are written to the ban file, one "ip|user <key> <until>
+// <strikes>" each line. The file is read again when it is changed by others, so
+// removing a line lifts the ban and adding one bans an ip or a user by hand.
+// Keys are percent-encoded as usernames come from clients, see escapeBanKey.
+type AuthGuard struct {
+	maxFails   int
+	window     time.Duration
+	banTime    time.Duration
+	maxBanTime time.Duration
+	file       string
+	lock       sync.Mutex
+	entries    map[string]*authGuardEntry
+	modTime    time.Time
+}
+
+type authGuardEntry struct {
+	fails   int
+	first   time.Time
+	until   time.Time
+	strikes int
+}
+
+// NewAuthGuard args:
+// maxFails   : failures within window which ban an ip or a user
+// window     : the period in which failures are counted
+// banTime    : the first ban, doubled with every ban in a row
+// maxBanTime : the longest ban, a key not banned for so long starts again from banTime
+// file       : ban file, "" means bans are not saved
+func NewAuthGuard(maxFails int, window, banTime, maxBanTime time.Duration, file string) (g *AuthGuard, err error) {
+	g = &AuthGuard{
+		maxFails:   maxFails,
+		window:     window,
+		banTime:    banTime,
+		maxBanTime: maxBanTime,
+		file:       file,
+		entries:    map[string]*authGuardEntry{},
+	}
+	if file != "" {
+		if _, e := os.Stat(file); e == nil {
+			if err = g.Reload(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			if g.isChanged() {
+				if err := g.Reload(); err != nil {
+					log.Printf("reload auth bans fail, keep the old bans, err: %s", err)
+				}
+			}
+			g.sweep()
+		}
+	}()
+	return
+}
+
+// Reload reads the bans from the ban file, bans which are not in it are
+// lifted.
+func (g *AuthGuard) Reload() (err error) {
+	info, err := os.Stat(g.file)
+	if err != nil {
+		return
+	}
+	content, err := ioutil.ReadFile(g.file)
+	if err != nil {
+		return
+	}
+	bans := map[string]*authGuardEntry{}
+	for i, line := range strings.Split(string(content), "\n") {
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		key, e, err := g.parseBan(fields)
+		if err != nil {
+			// a bad line must not lift the other bans or stop the start
+			log.Printf("%s line %d skipped: %s", g.file, i+1, err)
+			continue
+		}
+		bans[key] = e
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for key, e := range g.entries {
+		if ban, ok := bans[key]; ok {
+			e.until, e.strikes = ban.until, ban.strikes
+			delete(bans, key)
+		} else if e.until.After(time.Now()) {
+			e.until = time.Time{}
+			e.fails = 0
+			log.Printf("auth ban of %s lifted", key)
+		}
+	}
+	for key, e := range bans {
+		g.entries[key] = e
+	}
+	g.modTime = info.ModTime()
+	log.Printf("auth bans loaded from %s", g.file)
+	return
+}
+
+// parseBan parses the fields of a ban file line.
+func (g *AuthGuard) parseBan(fields []string) (key string, e *authGuardEntry, err error) {
+	if len(fields) < 2 || len(fields) > 4 || fields[0] != "ip" && fields[0] != "user" {
+		return "", nil, fmt.Errorf("want ip|user <key> [until] [strikes]")
+	}
+	value, err := unescapeBanKey(fields[1])
+	if err != nil {
+		return
+	}
+	// a ban added by hand without until lasts for maxBanTime
+	e = &authGuardEntry{until: time.Now().Add(g.maxBanTime), strikes: 1}
+	if len(fields) > 2 {
+		if e.until, err = time.Parse(time.RFC3339, fields[2]); err != nil {
+			return
+		}
+	}
+	if len(fields) > 3 {
+		if e.strikes, err = strconv.Atoi(fields[3]); err != nil {
+			return
+		}
+	}
+	return fields[0] + " " + value, e, nil
+}
+
+// escapeBanKey percent-encodes the bytes of key which would break a ban file
+// line: "%", "#", spaces and control bytes. The empty key is "-", and "-"
+// itself is "%2D".
+func escapeBanKey(key string) string {
+	switch key {
+	case "":
+		return "-"
+	case "-":
+		return "%2D"
+	}
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c <= ' ' || c == 0x7f || c == '%' || c == '#' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func unescapeBanKey(s string) (string, error) {
+	if s == "-" {
+		return "", nil
+	}
+	return url.PathUnescape(s)
+}
+
+func (g *AuthGuard) isChanged() bool {
+	if g.file == "" {
+		return false
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	info, err := os.Stat(g.file)
+	return err == nil && !info.ModTime().Equal(g.modTime)
+}
+
+// save writes the current bans to the ban file, g.lock must be held.
+func (g *AuthGuard) save() {
+	if g.file == "" {
+		return
+	}
+	now := time.Now()
+	var lines []string
+	for key, e := range g.entries {
+		if e.until.After(now) {
+			kv := strings.SplitN(key, " ", 2)
+			lines = append(lines, fmt.Sprintf("%s %s %s %d", kv[0], escapeBanKey(kv[1]), e.until.UTC().Format(time.RFC3339), e.strikes))
+		}
+	}
+	sort.Strings(lines)
+	content := "# ip|user <key> <until> <strikes>, remove a line to lift the ban\n" + strings.Join(lines, "\n") + "\n"
+	tmp, err := ioutil.TempFile(filepath.Dir(g.file), filepath.Base(g.file)+".tmp")
+	if err == nil {
+		_, err = tmp.WriteString(content)
+		if e := tmp.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), g.file)
+		}
+		os.Remove(tmp.Name())
+	}
+	if err != nil {
+		log.Printf("save auth bans to %s fail, err: %s", g.file, err)
+		return
+	}
+	if info, err := os.Stat(g.file); err == nil {
+		g.modTime = info.ModTime()
+	}
+}
+
+// banned returns the banned key of ip and user, "" if neither is banned.
+func (g *AuthGuard) banned(ip, user string) string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	for _, key := range []string{"ip " + ip, "user " + user} {
+		if e, ok := g.entries[key]; ok && e.until.After(now) {
+			return key
+		}
+	}
+	return ""
+}
+
+func (g *AuthGuard) fail(ip, user string) {
+	log.Printf("auth failure for user %q from %s", user, ip)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	changed := false
+	for _, key := range []string{"ip " + ip, "user " + user} {
+		e, ok := g.entries[key]
+		if !ok {
+			e = &authGuardEntry{}
+			g.entries[key] = e
+		}
+		if now.Sub(e.first) > g.window {
+			e.fails, e.first = 0, now
+		}
+		if e.fails++; e.fails < g.maxFails {
+			continue
+		}
+		if now.Sub(e.until) > g.maxBanTime {
+			e.strikes = 0
+		}
+		e.strikes++
+		d := g.banTime
+		for i := 1; i < e.strikes && d < g.maxBanTime; i++ {
+			d *= 2
+		}
+		if d > g.maxBanTime {
+			d = g.maxBanTime
+		}
+		e.until, e.fails = now.Add(d), 0
+		changed = true
+		log.Printf("auth ban of %s for %s after %d failures", key, d, g.maxFails)
+	}
+	if changed {
+		g.save()
+	}
+}
+
+func (g *AuthGuard) succeed(ip, user string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, key := range []string{"ip " + ip, "user " + user} {
+		if e, ok := g.entries[key]; ok {
+			e.fails = 0
+		}
+	}
+}
+
+// sweep drops keys without recent failures or bans.
+func (g *AuthGuard) sweep() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now()
+	for key, e := range g.entries {
+		if now.Sub(e.first) > g.window && now.Sub(e.until) > g.maxBanTime {
+			delete(g.entries, key)
+		}
+	}
+}
+
+// Guard returns auth checking the credentials of the client at addr with a
+// under the guard, a nil guard returns a.
+func (g *AuthGuard) Guard(a BasicAuth, addr net.Addr) BasicAuth {
+	if g == nil {
+		return a
+	}
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		ip = addr.String()
+	}
+	return &guardedAuth{guard: g, auth: a, ip: ip}
+}
+
+type guardedAuth struct {
+	guard *AuthGuard
+	auth  BasicAuth
+	ip    string
+}
+
+func (a *guardedAuth) Check(userpass string) (ok bool) {
+	user := strings.SplitN(userpass, ":", 2)[0]
+	if key := a.guard.banned(a.ip, user); key != "" {
+		log.Printf("auth rejected for user %q from %s, %s is banned", user, a.ip, key)
+		return false
+	}
+	if !a.auth.Check(userpass) {
+		a.guard.fail(a.ip, user)
+		return false
+	}
+	a.guard.succeed(a.ip, user)
+	return true
+}
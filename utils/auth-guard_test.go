@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type authFunc func(userpass string) bool
+
+func (f authFunc) Check(userpass string) bool {
+	return f(userpass)
+}
+
+func TestAuthGuard(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans")
+	g, err := NewAuthGuard(3, time.Minute, time.Minute, time.Hour, file)
+	assert.NoError(t, err)
+	auth := authFunc(func(userpass string) bool { return userpass == "alice:secret" })
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	a := g.Guard(auth, addr)
+
+	assert.False(t, a.Check("alice:a"))
+	assert.False(t, a.Check("alice:b"))
+	assert.True(t, a.Check("alice:secret"))
+	for i := 0; i < 3; i++ {
+		assert.False(t, a.Check("bob:x"))
+	}
+	// banned clients are rejected even with good credentials
+	assert.False(t, a.Check("alice:secret"))
+	assert.True(t, g.Guard(auth, &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}).Check("alice:secret"))
+	assert.False(t, g.Guard(auth, &net.TCPAddr{IP: net.ParseIP("10.0.0.2")}).Check("bob:x"))
+
+	content, _ := os.ReadFile(file)
+	assert.Contains(t, string(content), "ip 10.0.0.1 ")
+	assert.Contains(t, string(content), "user bob ")
+
+	// removing a line lifts the ban
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, "ip 10.0.0.1 ") {
+			lines = append(lines, line)
+		}
+	}
+	os.WriteFile(file, []byte(strings.Join(lines, "\n")), 0600)
+	assert.NoError(t, g.Reload())
+	assert.True(t, a.Check("alice:secret"))
+	assert.Equal(t, "user bob", g.banned("10.0.0.1", "bob"))
+}
+
+func TestAuthGuardBackoff(t *testing.T) {
+	g, err := NewAuthGuard(1, time.Minute, time.Minute, 3*time.Minute, "")
+	assert.NoError(t, err)
+	var bans []time.Duration
+	for i := 0; i < 4; i++ {
+		start := time.Now()
+		g.fail("10.0.0.1", "")
+		e := g.entries["ip 10.0.0.1"]
+		bans = append(bans, e.until.Sub(start).Round(time.Minute))
+		e.until = time.Now()
+	}
+	assert.Equal(t, []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}, bans)
+}
+
+func TestAuthGuardFileKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bans")
+	g, err := NewAuthGuard(1, time.Minute, time.Minute, time.Hour, file)
+	assert.NoError(t, err)
+	for _, user := range []string{"a b", "x\nip 10.9.9.9 2099-01-01T00:00:00Z 1", "", "-", "50%#"} {
+		g.fail("10.0.0.1", user)
+	}
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, 7, len(strings.Split(strings.TrimSpace(string(content)), "\n")), string(content))
+	os.WriteFile(file, append(content, "user a b c d e\nip\n"...), 0600)
+
+	// bad lines are skipped and the bans of usernames survive a restart
+	g, err = NewAuthGuard(1, time.Minute, time.Minute, time.Hour, file)
+	assert.NoError(t, err)
+	for _, user := range []string{"a b", "x\nip 10.9.9.9 2099-01-01T00:00:00Z 1", "", "-", "50%#"} {
+		assert.Equal(t, "user "+user, g.banned("10.0.0.2", user))
+	}
+	assert.Equal(t, "", g.banned("10.9.9.9", "z"))
+}
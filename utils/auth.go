@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// BasicAuth checks "username:password" credentials of clients.
+type BasicAuth interface {
+	Check(userpass string) (ok bool)
+}
+
+// AuthChain accepts credentials accepted by any of its backends, they are
+// asked in order.
+type AuthChain []BasicAuth
+
+func (c AuthChain) Check(userpass string) (ok bool) {
+	for _, auth := range c {
+		if auth.Check(userpass) {
+			return true
+		}
+	}
+	return false
+}
+
+// authCache keeps the verdicts of a slow backend for ttl, errors of the
+// backend are not cached.
+type authCache struct {
+	ttl  time.Duration
+	data ConcurrentMap
+}
+
+type authVerdict struct {
+	ok      bool
+	expires time.Time
+}
+
+func newAuthCache(ttl time.Duration) *authCache {
+	c := &authCache{
+		ttl:  ttl,
+		data: NewConcurrentMap(),
+	}
+	if ttl > 0 {
+		go func() {
+			for {
+				time.Sleep(ttl)
+				now := time.Now()
+				for k, v := range c.data.Items() {
+					if now.After(v.(authVerdict).expires) {
+						c.data.Remove(k)
+					}
+				}
+			}
+		}()
+	}
+	return c
+}
+
+func (c *authCache) check(userpass string, check func(user, pass string) (ok bool, err error)) (ok bool) {
+	u := strings.SplitN(userpass, ":", 2)
+	if len(u) != 2 {
+		return false
+	}
+	// the cache is keyed by a digest, so it holds no plaintext passwords
+	key := fmt.Sprintf("%x", sha256.Sum256([]byte(userpass)))
+	if c.ttl > 0 {
+		if v, found := c.data.Get(key); found && time.Now().Before(v.(authVerdict).expires) {
+			return v.(authVerdict).ok
+		}
+	}
+	ok, err := check(u[0], u[1])
+	if err != nil {
+		log.Printf("auth of user %s fail, err: %s", u[0], err)
+		return false
+	}
+	if c.ttl > 0 {
+		c.data.Set(key, authVerdict{ok: ok, expires: time.Now().Add(c.ttl)})
+	}
+	return
+}
+
+// HTTPAuth asks an http endpoint, which gets a GET request carrying the
+// credentials in the Authorization header. 2xx means accepted, 401 and 403
+// mean rejected, anything else is an error.
+type HTTPAuth struct {
+	url    string
+	client *http.Client
+	cache  *authCache
+}
+
+// NewHTTPAuth args:
+// url     : endpoint url
+// timeout : request timeout milliseconds
+// ttl     : seconds to cache a verdict, zero means no cache
+func NewHTTPAuth(url string, timeout, ttl int) *HTTPAuth {
+	return &HTTPAuth{
+		url:    url,
+		client: &http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		cache:  newAuthCache(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (a *HTTPAuth) Check(userpass string) (ok bool) {
+	return a.cache.check(userpass, func(user, pass string) (ok bool, err error) {
+		req, err := http.NewRequest("GET", a.url, nil)
+		if err != nil {
+			return
+		}
+		req.SetBasicAuth(user, pass)
+		resp, err := a.client.Do(req)
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return true, nil
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return false, nil
+		}
+		return false, fmt.Errorf("auth url response %s", resp.Status)
+	})
+}
+
+// CommandAuth runs a local command, which reads the username and the password
+// from stdin, one per line. Exit status 0 means accepted, 1 means rejected,
+// anything else is an error.
+type CommandAuth struct {
+	args    []string
+	timeout time.Duration
+	cache   *authCache
+}
+
+// NewCommandAuth args:
+// command : program and its arguments separated by spaces, no shell is used
+// timeout : milliseconds the command may run
+// ttl     : seconds to cache a verdict, zero means no cache
+func NewCommandAuth(command string, timeout, ttl int) *CommandAuth {
+	return &CommandAuth{
+		args:    strings.Fields(command),
+		timeout: time.Duration(timeout) * time.Millisecond,
+		cache:   newAuthCache(time.Duration(ttl) * time.Second),
+	}
+}
+
+func (a *CommandAuth) Check(userpass string) (ok bool) {
+	return a.cache.check(userpass, func(user, pass string) (ok bool, err error) {
+		if len(a.args) == 0 {
+			return false, fmt.Errorf("empty auth command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, a.args[0], a.args[1:]...)
+		cmd.Stdin = strings.NewReader(user + "\n" + pass + "\n")
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			return true, nil
+		}
+		if e, isExit := err.(*exec.ExitError); isExit && e.ExitCode() == 1 && ctx.Err() == nil {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s, output: %s", err, strings.TrimSpace(string(out)))
+	})
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPAuth(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		user, pass, _ := r.BasicAuth()
+		switch {
+		case user == "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case user != "user" || pass != "pass":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	auth := NewHTTPAuth(server.URL, 1000, 60)
+	assert.True(t, auth.Check("user:pass"))
+	assert.True(t, auth.Check("user:pass"))
+	assert.False(t, auth.Check("user:wrong"))
+	assert.False(t, auth.Check("user:wrong"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	assert.False(t, auth.Check("error:x"))
+	assert.False(t, auth.Check("error:x"))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+}
+
+func TestCommandAuth(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	script := filepath.Join(t.TempDir(), "auth.sh")
+	os.WriteFile(script, []byte("#!/bin/sh\nread user\nread pass\n[ \"$user:$pass\" = \"user:pass\" ] && exit 0\n[ \"$user\" = \"error\" ] && exit 2\nexit 1\n"), 0700)
+
+	auth := NewCommandAuth(script, 1000, 0)
+	assert.True(t, auth.Check("user:pass"))
+	assert.False(t, auth.Check("user:wrong"))
+	assert.False(t, auth.Check("error:x"))
+	assert.True(t, AuthChain{NewStaticAuth(), auth}.Check("user:pass"))
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// checkerLRU holds the hosts learned by a Checker, the least recently used
+// host is evicted when there are more than max, zero means no limit.
+type checkerLRU struct {
+	lock  sync.Mutex
+	max   int
+	list  *list.List
+	items map[string]*list.Element
+}
+
+type checkerEntry struct {
+	item CheckerItem
+	used time.Time
+}
+
+func newCheckerLRU(max int) *checkerLRU {
+	return &checkerLRU{
+		max:   max,
+		list:  list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// Get returns the item of host without using it.
+func (l *checkerLRU) Get(host string) (item CheckerItem, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.items[host]; ok {
+		return e.Value.(*checkerEntry).item, true
+	}
+	return
+}
+
+// Set stores and uses item.
+func (l *checkerLRU) Set(item CheckerItem) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.items[item.Host]; ok {
+		e.Value.(*checkerEntry).item = item
+		l.use(e)
+		return
+	}
+	l.insert(item)
+}
+
+// SetIfAbsent stores item if its host is new and uses it either way, it
+// reports whether item is stored.
+func (l *checkerLRU) SetIfAbsent(item CheckerItem) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.items[item.Host]; ok {
+		l.use(e)
+		return false
+	}
+	l.insert(item)
+	return true
+}
+
+// Update replaces the item of host by what update returns if keep is true,
+// ok tells whether host is there. A new host is stored as used now.
+func (l *checkerLRU) Update(host string, update func(item CheckerItem, ok bool) (CheckerItem, bool)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.items[host]
+	var item CheckerItem
+	if ok {
+		item = e.Value.(*checkerEntry).item
+	}
+	item, keep := update(item, ok)
+	if !keep {
+		return
+	}
+	if ok {
+		e.Value.(*checkerEntry).item = item
+	} else {
+		l.insert(item)
+	}
+}
+
+// Items returns all items, the most recently used first.
+func (l *checkerLRU) Items() (items []CheckerItem) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for e := l.list.Front(); e != nil; e = e.Next() {
+		items = append(items, e.Value.(*checkerEntry).item)
+	}
+	return
+}
+
+func (l *checkerLRU) Remove(host string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.items[host]; ok {
+		l.list.Remove(e)
+		delete(l.items, host)
+	}
+}
+
+// Expire removes the hosts not used for ttl.
+func (l *checkerLRU) Expire(ttl time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for e := l.list.Back(); e != nil && time.Since(e.Value.(*checkerEntry).used) > ttl; e = l.list.Back() {
+		l.list.Remove(e)
+		delete(l.items, e.Value.(*checkerEntry).item.Host)
+	}
+}
+
+func (l *checkerLRU) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.list.Len()
+}
+
+// use marks e as used now, l.lock must be held.
+func (l *checkerLRU) use(e *list.Element) {
+	e.Value.(*checkerEntry).used = time.Now()
+	l.list.MoveToFront(e)
+}
+
+// insert adds item as used now and evicts the least recently used hosts
+// beyond max, l.lock must be held.
+func (l *checkerLRU) insert(item CheckerItem) {
+	l.items[item.Host] = l.list.PushFront(&checkerEntry{item: item, used: time.Now()})
+	for l.max > 0 && l.list.Len() > l.max {
+		e := l.list.Back()
+		l.list.Remove(e)
+		delete(l.items, e.Value.(*checkerEntry).item.Host)
+	}
+}
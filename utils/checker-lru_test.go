@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckerLRU(t *testing.T) {
+	l := newCheckerLRU(2)
+	l.Set(CheckerItem{Host: "a:80"})
+	l.Set(CheckerItem{Host: "b:80"})
+	assert.False(t, l.SetIfAbsent(CheckerItem{Host: "a:80", FailCount: 1}))
+	l.Set(CheckerItem{Host: "c:80"})
+	_, ok := l.Get("b:80")
+	assert.False(t, ok)
+	item, ok := l.Get("a:80")
+	assert.True(t, ok)
+	assert.Equal(t, uint(0), item.FailCount)
+	assert.Equal(t, 2, l.Len())
+
+	l.lock.Lock()
+	l.items["a:80"].Value.(*checkerEntry).used = time.Now().Add(-time.Hour)
+	l.list.MoveToBack(l.items["a:80"])
+	l.lock.Unlock()
+	l.Expire(time.Minute)
+	assert.Equal(t, []CheckerItem{{Host: "c:80"}}, l.Items())
+}
+
+func TestCheckerDecay(t *testing.T) {
+	c := Checker{data: newCheckerLRU(0), halfLife: time.Hour}
+	item := CheckerItem{Host: "a.com:80", SuccessCount: 8, FailCount: 4, Updated: time.Now()}
+	assert.False(t, c.isNeedCheck(item))
+	item.Updated = time.Now().Add(-2 * time.Hour)
+	successN, failN := c.decayed(item)
+	assert.Equal(t, [2]uint{2, 1}, [2]uint{successN, failN})
+	assert.True(t, c.isNeedCheck(item))
+
+	// a blocked host turns direct once checks succeed again
+	c.data.Set(CheckerItem{Host: "b.com:443", FailCount: 6, Updated: time.Now().Add(-4 * time.Hour)})
+	for i := 0; i < 2; i++ {
+		c.record("b.com:443", nil)
+	}
+	blocked, failN, successN := c.IsBlocked("b.com:443")
+	assert.False(t, blocked)
+	assert.Equal(t, [2]uint{0, 2}, [2]uint{failN, successN})
+}
+
+func TestCheckerRace(t *testing.T) {
+	c := Checker{data: newCheckerLRU(0)}
+	assert.False(t, c.NeedRace("a.com:443"))
+	c.data.Set(CheckerItem{Host: "a.com:443", IsHTTPS: true})
+	assert.True(t, c.NeedRace("a.com:443"))
+	blocked, _, _ := c.IsBlocked("a.com:443")
+	assert.True(t, blocked)
+
+	// the parent connected faster although direct works
+	c.Raced("a.com:443", 300*time.Millisecond, 50*time.Millisecond, nil)
+	assert.False(t, c.NeedRace("a.com:443"))
+	blocked, _, successN := c.IsBlocked("a.com:443")
+	assert.True(t, blocked)
+	assert.Equal(t, uint(1), successN)
+
+	c.Raced("a.com:443", 30*time.Millisecond, 50*time.Millisecond, nil)
+	blocked, _, _ = c.IsBlocked("a.com:443")
+	assert.False(t, blocked)
+	// a failed direct request voids the race
+	c.Failed("a.com:443", io.EOF)
+	blocked, _, _ = c.IsBlocked("a.com:443")
+	assert.True(t, blocked)
+}
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The state file of a Checker keeps the learned hosts across restarts, one
+// each line:
+//
+//	<host:port> http|https <successes> <failures> <updated> [url]
+//
+// updated is the RFC3339 time of the last check. Instances may share a state
+// file, each takes the later checks of its hosts from it before writing it
+// and keeps the hosts of the others. The merge and the write hold a lock on
+// <state file>.lock, so instances in other processes do not lose each other's
+// hosts. Hosts are loaded from it only at start, bad lines are skipped.
+
+// loadState merges the hosts of the state file into c.data, see readState.
+// It returns the number of hosts taken from the file.
+func (c *Checker) loadState() (n int, err error) {
+	items, err := c.readState()
+	for _, item := range items {
+		c.data.Update(item.Host, func(old CheckerItem, exist bool) (CheckerItem, bool) {
+			if exist && !old.Updated.Before(item.Updated) {
+				return old, false
+			}
+			n++
+			return item, true
+		})
+	}
+	return
+}
+
+// mergeState takes the hosts of the state file which c.data has and which
+// were checked later. Hosts c.data does not have are not added, those it
+// dropped for its ttl or its size stay dropped, they are returned to be
+// written back for the other instances.
+func (c *Checker) mergeState() (others []CheckerItem, err error) {
+	items, err := c.readState()
+	for _, item := range items {
+		c.data.Update(item.Host, func(old CheckerItem, exist bool) (CheckerItem, bool) {
+			if !exist {
+				others = append(others, item)
+			}
+			return item, exist && old.Updated.Before(item.Updated)
+		})
+	}
+	return
+}
+
+// readState reads the hosts of the state file, hosts not checked for
+// stateMaxAge or ttl are dropped.
+func (c *Checker) readState() (items []CheckerItem, err error) {
+	content, err := ioutil.ReadFile(c.stateFile)
+	if err != nil {
+		return
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		item, e := parseCheckerItem(fields)
+		if e != nil {
+			log.Printf("%s line %d skipped: %s", c.stateFile, i+1, e)
+			continue
+		}
+		if age := time.Since(item.Updated); age > c.stateMaxAge || c.ttl > 0 && age > c.ttl {
+			continue
+		}
+		items = append(items, item)
+	}
+	return
+}
+
+func parseCheckerItem(fields []string) (item CheckerItem, err error) {
+	if len(fields) < 5 || len(fields) > 6 || fields[1] != "http" && fields[1] != "https" {
+		return item, fmt.Errorf("want <host:port> http|https <successes> <failures> <updated> [url]")
+	}
+	item.Host = fields[0]
+	item.Domain = strings.Split(item.Host, ":")[0]
+	item.IsHTTPS = fields[1] == "https"
+	item.Method = "GET"
+	if item.IsHTTPS {
+		item.Method = "CONNECT"
+	}
+	var success, fail uint64
+	if success, err = strconv.ParseUint(fields[2], 10, 32); err != nil {
+		return
+	}
+	if fail, err = strconv.ParseUint(fields[3], 10, 32); err != nil {
+		return
+	}
+	item.SuccessCount, item.FailCount = uint(success), uint(fail)
+	if item.Updated, err = time.Parse(time.RFC3339, fields[4]); err != nil {
+		return
+	}
+	if len(fields) == 6 {
+		item.URL = fields[5]
+	} else if !item.IsHTTPS {
+		item.URL = "http://" + item.Host + "/"
+	}
+	return
+}
+
+// SaveState writes the learned hosts to the state file, merged with the hosts
+// other instances wrote to it. Hosts not checked for stateMaxAge are dropped.
+func (c *Checker) SaveState() (err error) {
+	if c.stateFile == "" {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	unlock, err := lockFile(c.stateFile + ".lock")
+	if err != nil {
+		return
+	}
+	defer unlock()
+	others, err := c.mergeState()
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("merge checker state fail, overwrite it, err: %s", err)
+	}
+	var lines []string
+	for _, item := range append(c.data.Items(), others...) {
+		if time.Since(item.Updated) > c.stateMaxAge {
+			c.data.Remove(item.Host)
+			continue
+		}
+		scheme := "http"
+		if item.IsHTTPS {
+			scheme = "https"
+		}
+		line := fmt.Sprintf("%s %s %d %d %s", item.Host, scheme, item.SuccessCount, item.FailCount, item.Updated.UTC().Format(time.RFC3339))
+		if !item.IsHTTPS && item.URL != "" && !strings.ContainsAny(item.URL, " \t\r\n#") {
+			line += " " + item.URL
+		}
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	content := "# <host:port> http|https <successes> <failures> <updated> [url]\n" + strings.Join(lines, "\n") + "\n"
+	tmp, err := ioutil.TempFile(filepath.Dir(c.stateFile), filepath.Base(c.stateFile)+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.WriteString(content)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.stateFile)
+	}
+	os.Remove(tmp.Name())
+	return
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newStateChecker(file string) Checker {
+	return Checker{
+		data:        newCheckerLRU(0),
+		stateFile:   file,
+		stateMaxAge: time.Hour,
+		stateLock:   &sync.Mutex{},
+	}
+}
+
+func TestCheckerState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state")
+	now := time.Now().Truncate(time.Second)
+	c1 := newStateChecker(file)
+	c1.data.Set(CheckerItem{Host: "a.com:443", IsHTTPS: true, SuccessCount: 3, Updated: now.Add(-time.Minute)})
+	c1.data.Set(CheckerItem{Host: "old.com:80", FailCount: 5, Updated: now.Add(-2 * time.Hour)})
+	c2 := newStateChecker(file)
+	c2.data.Set(CheckerItem{Host: "a.com:443", IsHTTPS: true, FailCount: 4, Updated: now})
+	c2.data.Set(CheckerItem{Host: "b.com:80", URL: "http://b.com/x", SuccessCount: 1, Updated: now})
+
+	assert.NoError(t, c1.SaveState())
+	_, ok := c1.data.Get("old.com:80")
+	assert.False(t, ok)
+	assert.NoError(t, c2.SaveState())
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, 3, len(strings.Split(strings.TrimSpace(string(content)), "\n")))
+
+	c3 := newStateChecker(file)
+	n, err := c3.loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	v, _ := c3.data.Get("a.com:443")
+	assert.Equal(t, uint(4), v.FailCount)
+	assert.True(t, v.Updated.Equal(now))
+	v, _ = c3.data.Get("b.com:80")
+	assert.Equal(t, "http://b.com/x", v.URL)
+	blocked, _, _ := c3.IsBlocked("a.com:443")
+	assert.True(t, blocked)
+
+	// the host learned later wins
+	n, err = c1.loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = c1.loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestCheckerStateExpired(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state")
+	c := newStateChecker(file)
+	c.ttl = time.Minute
+	c.data.Set(CheckerItem{Host: "a.com:443", IsHTTPS: true, SuccessCount: 1, Updated: time.Now()})
+	c.data.Set(CheckerItem{Host: "b.com:443", IsHTTPS: true, SuccessCount: 1, Updated: time.Now()})
+	assert.NoError(t, c.SaveState())
+
+	// a host dropped for the ttl does not come back from the own file
+	c.data.lock.Lock()
+	c.data.items["a.com:443"].Value.(*checkerEntry).used = time.Now().Add(-time.Hour)
+	c.data.list.MoveToBack(c.data.items["a.com:443"])
+	c.data.lock.Unlock()
+	c.data.Expire(c.ttl)
+	assert.NoError(t, c.SaveState())
+	_, ok := c.data.Get("a.com:443")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.data.Len())
+
+	// and leaves the file once it was not checked for the ttl
+	content, _ := os.ReadFile(file)
+	assert.Contains(t, string(content), "a.com:443")
+	os.WriteFile(file, []byte(strings.Replace(string(content), time.Now().UTC().Format("2006-01-02"), "2000-01-01", 1)), 0600)
+	assert.NoError(t, c.SaveState())
+	content, _ = os.ReadFile(file)
+	assert.NotContains(t, string(content), "a.com:443")
+}
+
+func TestCheckerStateBadLines(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state")
+	now := time.Now().UTC().Format(time.RFC3339)
+	os.WriteFile(file, []byte("a.com:443 https 1 0 "+now+"\nbad line\nb.com:80 http x 0 "+now+"\nc.com:443 https 0 2 "+now+"\n"), 0600)
+	c := newStateChecker(file)
+	n, err := c.loadState()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	_, ok := c.data.Get("c.com:443")
+	assert.True(t, ok)
+}
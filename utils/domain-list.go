@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainList is the blocked or the direct list of a Checker, read from a file
+// or fetched from a http(s) url. A list holds domains, one each line, or
+// AdBlock Plus rules such as gfwlist, which may be base64 encoded:
+//
+//	example.com             example.com and its subdomains
+//	*.cdn.example.com       subdomains of cdn.example.com
+//	api-*.example.com       "*" and "?" match within a label
+//	||example.com^          example.com and its subdomains
+//	|https://example.com/a  the domain of the url
+//	.example.com/a          the domain of the rule
+//	/regexp/                hosts, or urls http://<host>/ and https://<host>/, matching the regexp
+//	@@<rule>                an exception, the host goes to the other list
+//	! comment
+//
+// Only hosts are routed, so rules of urls and paths match their whole domain,
+// options after "$" and element hiding rules are ignored.
+//
+// Domains are kept in a trie of labels from the top level domain down, with
+// globs indexed by their literal prefix or suffix, so their lookup costs about
+// the same for lists of any size. Regexps are joined into one, which is
+// slower with every regexp, lists such as gfwlist have a few dozen.
+type DomainList struct {
+	source          string
+	cacheDir        string
+	lock            sync.RWMutex
+	n               int
+	domains         *domainTrie
+	exceptions      *domainTrie
+	regexp          *regexp.Regexp
+	exceptionRegexp *regexp.Regexp
+}
+
+// domainTrie is a node of the labels of domains, a node is reached by the
+// labels of a domain from the top level one.
+type domainTrie struct {
+	// end tells a domain ends here, which matches its subdomains too
+	end      bool
+	children map[string]*domainTrie
+	// globs are children of labels with "*" or "?", indexed by their
+	// literal prefix, or by their suffix if it is longer, so a label is only
+	// matched against the globs which share one with it
+	prefixGlobs, suffixGlobs domainGlobs
+}
+
+type domainTrieGlob struct {
+	pattern string
+	node    *domainTrie
+}
+
+// domainGlobs indexes globs by a literal affix, maxLen is the longest one.
+type domainGlobs struct {
+	globs  map[string][]domainTrieGlob
+	maxLen int
+}
+
+// get returns the node of pattern, which is added if it is new.
+func (x *domainGlobs) get(affix, pattern string) *domainTrie {
+	for _, g := range x.globs[affix] {
+		if g.pattern == pattern {
+			return g.node
+		}
+	}
+	if x.globs == nil {
+		x.globs = map[string][]domainTrieGlob{}
+	}
+	node := &domainTrie{}
+	x.globs[affix] = append(x.globs[affix], domainTrieGlob{pattern: pattern, node: node})
+	if len(affix) > x.maxLen {
+		x.maxLen = len(affix)
+	}
+	return node
+}
+
+// match reports whether a glob of affix matches label and its node rest.
+func (x *domainGlobs) match(affix, label, rest string) bool {
+	for _, g := range x.globs[affix] {
+		if ok, _ := path.Match(g.pattern, label); ok && g.node.match(rest) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *domainTrie) insert(domain string) {
+	for node := t; ; {
+		label, rest := lastLabel(domain)
+		var next *domainTrie
+		if i := strings.IndexAny(label, "*?"); i != -1 {
+			prefix, suffix := label[:i], label[strings.LastIndexAny(label, "*?")+1:]
+			if len(suffix) > len(prefix) {
+				next = node.suffixGlobs.get(suffix, label)
+			} else {
+				next = node.prefixGlobs.get(prefix, label)
+			}
+		} else {
+			if next = node.children[label]; next == nil {
+				if node.children == nil {
+					node.children = map[string]*domainTrie{}
+				}
+				next = &domainTrie{}
+				node.children[label] = next
+			}
+		}
+		if node, domain = next, rest; domain == "" {
+			node.end = true
+			return
+		}
+	}
+}
+
+// match reports whether host is under a domain ending in or below t.
+func (t *domainTrie) match(host string) bool {
+	if t.end {
+		return true
+	}
+	if host == "" {
+		return false
+	}
+	label, rest := lastLabel(host)
+	if child, ok := t.children[label]; ok && child.match(rest) {
+		return true
+	}
+	for i := 0; i <= len(label) && i <= t.prefixGlobs.maxLen; i++ {
+		if t.prefixGlobs.match(label[:i], label, rest) {
+			return true
+		}
+	}
+	for i := 1; i <= len(label) && i <= t.suffixGlobs.maxLen; i++ {
+		if t.suffixGlobs.match(label[len(label)-i:], label, rest) {
+			return true
+		}
+	}
+	return false
+}
+
+// lastLabel splits the last label off a domain.
+func lastLabel(domain string) (label, rest string) {
+	if i := strings.LastIndexByte(domain, '.'); i != -1 {
+		return domain[i+1:], domain[:i]
+	}
+	return domain, ""
+}
+
+// NewDomainList args:
+// source   : list file or http(s) url, "" or a missing file is an empty list
+// refresh  : fetch a url again every refresh seconds
+// cacheDir : directory of the local copy of a url, which is used until the url is fetched
+func NewDomainList(source string, refresh int, cacheDir string) (l *DomainList) {
+	l = ParseDomainList("")
+	l.source, l.cacheDir = source, cacheDir
+	if !isListURL(source) {
+		if source != "" && PathExists(source) {
+			content, err := ioutil.ReadFile(source)
+			if err != nil {
+				log.Printf("load file err:%s", err)
+				return
+			}
+			l.load(string(content))
+		}
+		return
+	}
+	stale := true
+	if info, err := os.Stat(l.cacheFile()); err == nil {
+		if content, err := ioutil.ReadFile(l.cacheFile()); err == nil {
+			l.load(string(content))
+			stale = time.Since(info.ModTime()) > time.Duration(refresh)*time.Second
+		}
+	}
+	go func() {
+		for {
+			if stale {
+				if err := l.fetch(); err != nil {
+					log.Printf("fetch list %s fail, keep the old list, err: %s", source, err)
+				}
+			}
+			stale = true
+			time.Sleep(time.Duration(refresh) * time.Second)
+		}
+	}()
+	return
+}
+
+// ParseDomainList parses the content of a list.
+func ParseDomainList(content string) (l *DomainList) {
+	l = &DomainList{}
+	l.load(content)
+	return
+}
+
+func isListURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// cacheFile is the local copy of the list url.
+func (l *DomainList) cacheFile() string {
+	sum := sha1.Sum([]byte(l.source))
+	return filepath.Join(l.cacheDir, "goproxy-list-"+hex.EncodeToString(sum[:8])+".txt")
+}
+
+// fetch gets the list url, loads it and saves the local copy.
+func (l *DomainList) fetch() (err error) {
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(l.source)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	n := l.load(string(content))
+	log.Printf("list %s fetched, rules: %d", l.source, n)
+	tmp, err := ioutil.TempFile(filepath.Dir(l.cacheFile()), filepath.Base(l.cacheFile())+".tmp")
+	if err == nil {
+		_, err = tmp.Write(content)
+		if e := tmp.Close(); err == nil {
+			err = e
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), l.cacheFile())
+		}
+		os.Remove(tmp.Name())
+	}
+	if err != nil {
+		log.Printf("save list %s to %s fail, err: %s", l.source, l.cacheFile(), err)
+	}
+	return nil
+}
+
+// load replaces the rules by those of content and returns their number.
+func (l *DomainList) load(content string) (n int) {
+	content = decodeBase64List(content)
+	domains, exceptions := &domainTrie{}, &domainTrie{}
+	var regexps, exceptionRegexps []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.Trim(line, "\r \t")
+		if line == "" || line[0] == '!' || line[0] == '[' || line[0] == '#' || strings.Contains(line, "##") || strings.Contains(line, "#@#") {
+			continue
+		}
+		exception := strings.HasPrefix(line, "@@")
+		line = strings.TrimPrefix(line, "@@")
+		if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+			expr := line[1 : len(line)-1]
+			if _, err := regexp.Compile(expr); err != nil {
+				log.Printf("invalid list rule %s, err: %s", line, err)
+				continue
+			}
+			if exception {
+				exceptionRegexps = append(exceptionRegexps, expr)
+			} else {
+				regexps = append(regexps, expr)
+			}
+			n++
+			continue
+		}
+		domain := listRuleDomain(line)
+		if domain == "" {
+			continue
+		}
+		if exception {
+			exceptions.insert(domain)
+		} else {
+			domains.insert(domain)
+		}
+		n++
+	}
+	l.lock.Lock()
+	l.n, l.domains, l.exceptions = n, domains, exceptions
+	l.regexp, l.exceptionRegexp = joinRegexps(regexps), joinRegexps(exceptionRegexps)
+	l.lock.Unlock()
+	return
+}
+
+// joinRegexps compiles the alternation of exprs, which are valid, nil if
+// there is none.
+func joinRegexps(exprs []string) *regexp.Regexp {
+	if len(exprs) == 0 {
+		return nil
+	}
+	return regexp.MustCompile("(?:" + strings.Join(exprs, ")|(?:") + ")")
+}
+
+// decodeBase64List decodes a base64 encoded list such as gfwlist, content
+// which is not base64 is returned as it is. A list of domains always has a
+// "." which base64 has not.
+func decodeBase64List(content string) string {
+	if strings.Contains(content, ".") {
+		return content
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(content), ""))
+	if err != nil {
+		return content
+	}
+	return string(decoded)
+}
+
+// listRuleDomain returns the domain of an AdBlock Plus rule or a plain
+// domain, "" if the rule has none.
+func listRuleDomain(rule string) string {
+	if i := strings.IndexByte(rule, '$'); i != -1 {
+		rule = rule[:i]
+	}
+	switch {
+	case strings.HasPrefix(rule, "||"):
+		rule = rule[2:]
+	case strings.HasPrefix(rule, "|"):
+		u, err := url.Parse(rule[1:])
+		if err != nil {
+			return ""
+		}
+		rule = u.Host
+	}
+	rule = strings.TrimPrefix(rule, ".")
+	if i := strings.IndexAny(rule, "^/:|"); i != -1 {
+		rule = rule[:i]
+	}
+	rule = strings.ToLower(strings.TrimSuffix(rule, "."))
+	// a rule of wildcards only would match every host
+	if !strings.Contains(rule, ".") || strings.ContainsAny(rule, "[] ") || strings.Trim(rule, "*?.") == "" {
+		return ""
+	}
+	return rule
+}
+
+// Len returns the number of rules.
+func (l *DomainList) Len() int {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.n
+}
+
+// Match reports whether a rule matches host, excepted is true if an
+// exception does, which takes precedence.
+func (l *DomainList) Match(host string) (matched, excepted bool) {
+	if l == nil {
+		return
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if l.exceptions.match(host) || matchListRegexp(l.exceptionRegexp, host) {
+		return false, true
+	}
+	return l.domains.match(host) || matchListRegexp(l.regexp, host), false
+}
+
+func matchListRegexp(re *regexp.Regexp, host string) bool {
+	return re != nil && (re.MatchString(host) || re.MatchString("http://"+host+"/") || re.MatchString("https://"+host+"/"))
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainList(t *testing.T) {
+	rules := `[AutoProxy 0.2.9]
+! Checksum: xxx
+||google.com^
+|https://www.example.org/path
+.twitter.com/search
+plain.example.net
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+||ads.example.com^$third-party
+@@||news.google.com
+example.com##.banner
+`
+	for _, content := range []string{rules, base64.StdEncoding.EncodeToString([]byte(rules))} {
+		l := ParseDomainList(content)
+		assert.Equal(t, 7, l.Len())
+		for host, want := range map[string][2]bool{
+			"google.com":         {true, false},
+			"www.google.com":     {true, false},
+			"news.google.com":    {false, true},
+			"notgoogle.com":      {false, false},
+			"www.example.org":    {true, false},
+			"example.org":        {false, false},
+			"mobile.twitter.com": {true, false},
+			"plain.example.net":  {true, false},
+			"foo.blogspot.com":   {true, false},
+			"ads.example.com":    {true, false},
+			"example.com":        {false, false},
+			"com":                {false, false},
+			"WWW.GOOGLE.COM.":    {true, false},
+		} {
+			matched, excepted := l.Match(host)
+			assert.Equal(t, want, [2]bool{matched, excepted}, host)
+		}
+	}
+}
+
+func TestCheckerInList(t *testing.T) {
+	c := Checker{
+		blockedMap: ParseDomainList("||google.com\n@@||google.cn\n"),
+		directMap:  ParseDomainList("baidu.com\n@@||pan.baidu.com\n"),
+	}
+	for address, want := range map[string][2]bool{
+		"www.google.com:443": {true, true},
+		"google.cn:443":      {true, false},
+		"www.baidu.com:80":   {true, false},
+		"pan.baidu.com:80":   {true, true},
+		"example.com:80":     {false, false},
+	} {
+		listed, blocked := c.InList(address)
+		assert.Equal(t, want, [2]bool{listed, blocked}, address)
+	}
+}
+
+func TestDomainListWildcards(t *testing.T) {
+	l := ParseDomainList(`*.cdn.example.com
+api-*.example.com
+img?.example.net
+*-edge.example.net
+||*.ads.example.org^
+/^v[0-9]+\.example\.io$/
+`)
+	for host, want := range map[string]bool{
+		"a.cdn.example.com":    true,
+		"a.b.cdn.example.com":  true,
+		"cdn.example.com":      false,
+		"api-eu.example.com":   true,
+		"x.api-eu.example.com": true,
+		"api.example.com":      false,
+		"img1.example.net":     true,
+		"img12.example.net":    false,
+		"us-edge.example.net":  true,
+		"us-edge1.example.net": false,
+		"a.ads.example.org":    true,
+		"v2.example.io":        true,
+		"www.v2.example.io":    false,
+		"example.com":          false,
+	} {
+		matched, _ := l.Match(host)
+		assert.Equal(t, want, matched, host)
+	}
+	assert.Equal(t, 0, ParseDomainList("*.*\n*\n").Len())
+}
+
+// benchmarkDomainList matches hosts against a list of size rules, globs in
+// the same domain and a regexp every hundred rules.
+func benchmarkDomainList(b *testing.B, size int) {
+	var lines []string
+	for i := 0; i < size; i++ {
+		switch {
+		case i%100 == 99:
+			lines = append(lines, fmt.Sprintf(`/^ads%d\.tracker[0-9]+\.com$/`, i))
+		case i%4 == 0:
+			lines = append(lines, fmt.Sprintf("*.cdn%d.example.com", i))
+		case i%4 == 1:
+			lines = append(lines, fmt.Sprintf("api%d-*.example.com", i))
+		case i%4 == 2:
+			lines = append(lines, fmt.Sprintf("*-edge%d.example.net", i))
+		default:
+			lines = append(lines, fmt.Sprintf("||domain%d.org^", i))
+		}
+	}
+	l := ParseDomainList(strings.Join(lines, "\n"))
+	hosts := []string{"www.domain3.org", "a.cdn4.example.com", "api5-eu.example.com", "us-edge6.example.net", "ads99.tracker1.com", "www.unknown.com", "a.b.c.d.miss.org", "api-x.example.com"}
+	for _, host := range hosts[:5] {
+		if matched, _ := l.Match(host); !matched {
+			b.Fatalf("%s not matched", host)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Match(hosts[i%len(hosts)])
+	}
+}
+
+func BenchmarkDomainList1k(b *testing.B)   { benchmarkDomainList(b, 1000) }
+func BenchmarkDomainList10k(b *testing.B)  { benchmarkDomainList(b, 10000) }
+func BenchmarkDomainList100k(b *testing.B) { benchmarkDomainList(b, 100000) }
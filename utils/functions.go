@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/tls"
 	"crypto/x509"
@@ -24,6 +23,17 @@ import (
 )
 
 func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), bytesPreSec float64) {
+	var download, upload Limiters
+	if bytesPreSec > 0 {
+		download = Limiters{NewRateLimiter(bytesPreSec)}
+		upload = Limiters{NewRateLimiter(bytesPreSec)}
+	}
+	IoBindLimit(dst, src, fn, cfn, download, upload)
+}
+
+// IoBindLimit is IoBind with limiters which may be shared with other conns,
+// download limits the bytes read from src, upload the bytes read from dst.
+func IoBindLimit(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err error), cfn func(count int, isPositive bool), download, upload Limiters) {
 	var one = &sync.Once{}
 	go func() {
 		defer func() {
@@ -31,20 +41,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 				log.Printf("IoBind crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
 			}
 		}()
-		var err error
-		var isSrcErr bool
-		if bytesPreSec > 0 {
-			newreader := NewReader(src)
-			newreader.SetRateLimit(bytesPreSec)
-			_, isSrcErr, err = ioCopy(dst, newreader, func(c int) {
-				cfn(c, false)
-			})
-
-		} else {
-			_, isSrcErr, err = ioCopy(dst, src, func(c int) {
-				cfn(c, false)
-			})
-		}
+		_, isSrcErr, err := ioCopy(dst, download.Reader(src), func(c int) {
+			cfn(c, false)
+		})
 		if err != nil {
 			one.Do(func() {
 				fn(isSrcErr, err)
@@ -57,19 +56,9 @@ func IoBind(dst io.ReadWriter, src io.ReadWriter, fn func(isSrcErr bool, err err
 				log.Printf("IoBind crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
 			}
 		}()
-		var err error
-		var isSrcErr bool
-		if bytesPreSec > 0 {
-			newReader := NewReader(dst)
-			newReader.SetRateLimit(bytesPreSec)
-			_, isSrcErr, err = ioCopy(src, newReader, func(c int) {
-				cfn(c, true)
-			})
-		} else {
-			_, isSrcErr, err = ioCopy(src, dst, func(c int) {
-				cfn(c, true)
-			})
-		}
+		_, isSrcErr, err := ioCopy(src, upload.Reader(dst), func(c int) {
+			cfn(c, true)
+		})
 		if err != nil {
 			one.Do(func() {
 				fn(isSrcErr, err)
@@ -287,8 +276,11 @@ func UDPPacket(srcAddr string, packet []byte) []byte {
 	binary.Write(pkg, binary.LittleEndian, packet)
 	return pkg.Bytes()
 }
+
+// ReadUDPPacket reads one packet written by UDPPacket. It does not buffer
+// beyond the packet, so it can be called repeatedly on the same conn.
 func ReadUDPPacket(conn *net.Conn) (srcAddr string, packet []byte, err error) {
-	reader := bufio.NewReader(*conn)
+	reader := *conn
 	var addrLength uint16
 	var bodyLength uint16
 	err = binary.Read(reader, binary.LittleEndian, &addrLength)
@@ -296,13 +288,10 @@ func ReadUDPPacket(conn *net.Conn) (srcAddr string, packet []byte, err error) {
 		return
 	}
 	_srcAddr := make([]byte, addrLength)
-	n, err := reader.Read(_srcAddr)
+	_, err = io.ReadFull(reader, _srcAddr)
 	if err != nil {
 		return
 	}
-	if n != int(addrLength) {
-		return
-	}
 	srcAddr = string(_srcAddr)
 
 	err = binary.Read(reader, binary.LittleEndian, &bodyLength)
@@ -310,13 +299,7 @@ func ReadUDPPacket(conn *net.Conn) (srcAddr string, packet []byte, err error) {
 		return
 	}
 	packet = make([]byte, bodyLength)
-	n, err = reader.Read(packet)
-	if err != nil {
-		return
-	}
-	if n != int(bodyLength) {
-		return
-	}
+	_, err = io.ReadFull(reader, packet)
 	return
 }
 
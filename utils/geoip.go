@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoIP looks up the country and the autonomous system of ips in MaxMind
+// databases, such as GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb, the first
+// database knowing an ip answers. The files are read again when changed.
+type GeoIP struct {
+	files    []string
+	lock     sync.RWMutex
+	dbs      []*mmdb
+	modTimes map[string]time.Time
+}
+
+// NewGeoIP args:
+// files    : mmdb files of country, city or asn databases
+// interval : check the files for changes every interval seconds, zero means no reload
+func NewGeoIP(files []string, interval int) (g *GeoIP, err error) {
+	g = &GeoIP{files: files}
+	if err = g.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(interval) * time.Second)
+				if g.isChanged() {
+					if err := g.Reload(); err != nil {
+						log.Printf("reload geoip db fail, keep the old db, err: %s", err)
+					}
+				}
+			}
+		}()
+	}
+	return
+}
+
+// Reload reads all files again.
+func (g *GeoIP) Reload() (err error) {
+	var dbs []*mmdb
+	modTimes := map[string]time.Time{}
+	for _, file := range g.files {
+		var info os.FileInfo
+		if info, err = os.Stat(file); err != nil {
+			return
+		}
+		var buf []byte
+		if buf, err = ioutil.ReadFile(file); err != nil {
+			return
+		}
+		var db *mmdb
+		if db, err = parseMMDB(buf); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		dbs = append(dbs, db)
+		modTimes[file] = info.ModTime()
+		log.Printf("geoip db %s loaded, type: %s", file, db.dbType)
+	}
+	g.lock.Lock()
+	g.dbs, g.modTimes = dbs, modTimes
+	g.lock.Unlock()
+	return
+}
+
+func (g *GeoIP) isChanged() bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	for _, file := range g.files {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(g.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the ISO country code and the AS number of ip, "" and 0 if
+// they are unknown.
+func (g *GeoIP) Lookup(ip net.IP) (country string, asn uint) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	for _, db := range g.dbs {
+		record, err := db.lookup(ip)
+		if err != nil {
+			log.Printf("geoip lookup of %s fail, err: %s", ip, err)
+			continue
+		}
+		if country == "" {
+			country, _ = mmdbPath(record, "country", "iso_code").(string)
+			if country == "" {
+				country, _ = mmdbPath(record, "registered_country", "iso_code").(string)
+			}
+		}
+		if asn == 0 {
+			asn = mmdbUint(mmdbPath(record, "autonomous_system_number"))
+		}
+		if country != "" && asn != 0 {
+			break
+		}
+	}
+	return
+}
+
+// LookupHost is Lookup of the first ip of host, which is resolved if it is a
+// domain.
+func (g *GeoIP) LookupHost(host string) (country string, asn uint) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(strings.TrimSuffix(host, "."))
+		if err != nil || len(ips) == 0 {
+			return
+		}
+		ip = ips[0]
+	}
+	return g.Lookup(ip)
+}
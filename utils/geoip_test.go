@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mmdbNode struct {
+	children [2]*mmdbNode
+	data     []byte
+	number   int
+}
+
+func mmdbEncode(v interface{}) []byte {
+	ctrl := func(typ, size int) []byte {
+		return []byte{byte(typ<<5 | size)}
+	}
+	switch v := v.(type) {
+	case string:
+		return append(ctrl(2, len(v)), v...)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return append(ctrl(6, 4), b...)
+	case map[string]interface{}:
+		var keys []string
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b := ctrl(7, len(v))
+		for _, k := range keys {
+			b = append(b, mmdbEncode(k)...)
+			b = append(b, mmdbEncode(v[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// buildMMDB returns an ipv6 maxmind db with 24 bit records of the networks,
+// ipv4 networks are stored under ::/96.
+func buildMMDB(networks map[string]map[string]interface{}) []byte {
+	root := &mmdbNode{}
+	for cidr, record := range networks {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		ip, ones := ipNet.IP.To16(), 0
+		if ipNet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones, _ = ipNet.Mask.Size()
+			ones += 96
+		} else {
+			ones, _ = ipNet.Mask.Size()
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := ip[i/8] >> (7 - uint(i%8)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbNode{}
+			}
+			node = node.children[bit]
+		}
+		node.data = mmdbEncode(record)
+	}
+	var nodes []*mmdbNode
+	var number func(n *mmdbNode)
+	number = func(n *mmdbNode) {
+		if n == nil || n.data != nil {
+			return
+		}
+		n.number = len(nodes)
+		nodes = append(nodes, n)
+		number(n.children[0])
+		number(n.children[1])
+	}
+	number(root)
+	var tree, data []byte
+	for _, n := range nodes {
+		for _, child := range n.children {
+			value := len(nodes)
+			if child != nil && child.data != nil {
+				value = len(nodes) + 16 + len(data)
+				data = append(data, child.data...)
+			} else if child != nil {
+				value = child.number
+			}
+			tree = append(tree, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	buf := append(tree, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	return append(buf, mmdbEncode(map[string]interface{}{
+		"node_count":    uint32(len(nodes)),
+		"record_size":   uint32(24),
+		"ip_version":    uint32(6),
+		"database_type": "Test",
+	})...)
+}
+
+func TestGeoIP(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "test.mmdb")
+	os.WriteFile(file, buildMMDB(map[string]map[string]interface{}{
+		"1.0.0.0/24": {
+			"country":                  map[string]interface{}{"iso_code": "AU"},
+			"autonomous_system_number": uint32(13335),
+		},
+		"2.0.0.0/8":     {"registered_country": map[string]interface{}{"iso_code": "FR"}},
+		"2001:db8::/32": {"country": map[string]interface{}{"iso_code": "CN"}},
+	}), 0600)
+	g, err := NewGeoIP([]string{file}, 0)
+	assert.NoError(t, err)
+	country, asn := g.Lookup(net.ParseIP("1.0.0.1"))
+	assert.Equal(t, "AU", country)
+	assert.Equal(t, uint(13335), asn)
+	country, _ = g.Lookup(net.ParseIP("2.3.4.5"))
+	assert.Equal(t, "FR", country)
+	country, _ = g.LookupHost("[2001:db8::1]:443")
+	assert.Equal(t, "CN", country)
+	country, asn = g.Lookup(net.ParseIP("3.0.0.1"))
+	assert.Equal(t, "", country)
+	assert.Equal(t, uint(0), asn)
+
+	r, err := ParseRules("geoip:au asn:AS13335 reject\ngeoip:fr direct\n")
+	assert.NoError(t, err)
+	r.SetGeoIP(g)
+	route, _ := r.Match("1.0.0.1:443", nil, "")
+	assert.Equal(t, RouteReject, route.Action)
+	route, _ = r.Match("2.0.0.1:443", nil, "")
+	assert.Equal(t, RouteDirect, route.Action)
+	_, ok := r.Match("3.0.0.1:443", nil, "")
+	assert.False(t, ok)
+
+	os.WriteFile(file, []byte("not a db"), 0600)
+	assert.Error(t, g.Reload())
+}
+
+func TestMMDBDecodeCycle(t *testing.T) {
+	// a map whose value points back to the map
+	_, _, err := mmdbDecode([]byte{0xe1, 0x41, 'a', 0x20, 0x00}, 0, 0)
+	assert.Equal(t, errMMDBCorrupt, err)
+}
@@ -0,0 +1,338 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// password hash algorithms of htpasswd files
+const (
+	HashBcrypt = "bcrypt"
+	HashSHA512 = "sha512"
+	HashSHA256 = "sha256"
+	HashSHA1   = "sha"
+)
+
+const (
+	shaCryptRoundsDefault = 5000
+	shaCryptRoundsMin     = 1000
+	shaCryptRoundsMax     = 999999999
+	shaCryptSaltMax       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var sha256CryptPerm = [][3]int{
+	{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+}
+var sha512CryptPerm = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// IsPasswordHash reports whether stored is a hash VerifyPassword knows,
+// anything else is taken as a plaintext password.
+func IsPasswordHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$") ||
+		strings.HasPrefix(stored, "$5$") || strings.HasPrefix(stored, "$6$") || strings.HasPrefix(stored, "{SHA}")
+}
+
+// VerifyPassword checks pass against stored, which is a bcrypt, SHA-256/512
+// crypt or {SHA} hash as written by htpasswd, or a plaintext password. The
+// comparison is constant time.
+func VerifyPassword(stored, pass string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(stored, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(pass)) == nil
+	case strings.HasPrefix(stored, "$5$"):
+		computed = shaCryptFromHash(sha256.New, "$5$", sha256CryptPerm, stored, pass)
+	case strings.HasPrefix(stored, "$6$"):
+		computed = shaCryptFromHash(sha512.New, "$6$", sha512CryptPerm, stored, pass)
+	case strings.HasPrefix(stored, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		computed = pass
+	}
+	// compare digests, so the time does not depend on the lengths either
+	a, b := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(computed))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// HashPassword hashes pass with algorithm, cost is only used by bcrypt.
+func HashPassword(pass, algorithm string, cost int) (stored string, err error) {
+	switch algorithm {
+	case HashBcrypt:
+		var b []byte
+		b, err = bcrypt.GenerateFromPassword([]byte(pass), cost)
+		stored = string(b)
+	case HashSHA256, HashSHA512:
+		salt := make([]byte, shaCryptSaltMax)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		for i := range salt {
+			salt[i] = cryptAlphabet[int(salt[i])%len(cryptAlphabet)]
+		}
+		if algorithm == HashSHA256 {
+			stored = shaCrypt(sha256.New, "$5$", sha256CryptPerm, []byte(pass), salt, shaCryptRoundsDefault, false)
+		} else {
+			stored = shaCrypt(sha512.New, "$6$", sha512CryptPerm, []byte(pass), salt, shaCryptRoundsDefault, false)
+		}
+	case HashSHA1:
+		sum := sha1.Sum([]byte(pass))
+		stored = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	default:
+		err = fmt.Errorf("unknown hash algorithm: %s", algorithm)
+	}
+	return
+}
+
+// shaCryptFromHash computes the SHA-crypt of pass with the salt and rounds
+// of stored, "" is returned when stored is malformed.
+func shaCryptFromHash(newHash func() hash.Hash, magic string, perm [][3]int, stored, pass string) string {
+	rest := strings.TrimPrefix(stored, magic)
+	rounds, custom := shaCryptRoundsDefault, false
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.IndexByte(rest, '$')
+		if i == -1 {
+			return ""
+		}
+		n, err := strconv.Atoi(rest[len("rounds="):i])
+		if err != nil {
+			return ""
+		}
+		rounds, custom = n, true
+		rest = rest[i+1:]
+	}
+	salt := rest
+	if i := strings.IndexByte(rest, '$'); i != -1 {
+		salt = rest[:i]
+	}
+	return shaCrypt(newHash, magic, perm, []byte(pass), []byte(salt), rounds, custom)
+}
+
+// shaCrypt implements https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(newHash func() hash.Hash, magic string, perm [][3]int, pass, salt []byte, rounds int, custom bool) string {
+	if len(salt) > shaCryptSaltMax {
+		salt = salt[:shaCryptSaltMax]
+	}
+	if rounds < shaCryptRoundsMin {
+		rounds = shaCryptRoundsMin
+	} else if rounds > shaCryptRoundsMax {
+		rounds = shaCryptRoundsMax
+	}
+	h := newHash()
+	size := h.Size()
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(pass)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(pass)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(pass)))
+	for n := len(pass); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(pass)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for i := 0; i < len(pass); i++ {
+		h.Write(pass)
+	}
+	p := repeatBytes(h.Sum(nil), len(pass))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := bytes.NewBufferString(magic)
+	if custom {
+		fmt.Fprintf(out, "rounds=%d$", rounds)
+	}
+	out.Write(salt)
+	out.WriteByte('$')
+	for _, t := range perm {
+		cryptBase64(out, c[t[0]], c[t[1]], c[t[2]], 4)
+	}
+	if size == sha256.Size {
+		cryptBase64(out, 0, c[31], c[30], 3)
+	} else {
+		cryptBase64(out, 0, 0, c[63], 2)
+	}
+	return out.String()
+}
+
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) < len(b) {
+			b = b[:n-len(out)]
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+func cryptBase64(out *bytes.Buffer, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
+
+// Passwd creates, updates or deletes user in the htpasswd file. The password
+// is prompted for on a terminal, otherwise the first line of stdin is used.
+func Passwd(file, user, algorithm string, cost int, del bool) (err error) {
+	if user == "" || strings.ContainsAny(user, ":\r\n") {
+		return fmt.Errorf("invalid username: %q", user)
+	}
+	var lines []string
+	content, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimRight(strings.Replace(string(content), "\r", "", -1), "\n"), "\n")
+	}
+	found := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, user+":") {
+			found = i
+			break
+		}
+	}
+	if del {
+		if found == -1 {
+			return fmt.Errorf("user %s not found in %s", user, file)
+		}
+		lines = append(lines[:found], lines[found+1:]...)
+	} else {
+		var pass, stored string
+		if pass, err = readNewPassword(); err != nil {
+			return
+		}
+		if stored, err = HashPassword(pass, algorithm, cost); err != nil {
+			return
+		}
+		if found == -1 {
+			lines = append(lines, user+":"+stored)
+		} else {
+			lines[found] = user + ":" + stored
+		}
+	}
+	data := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		data += "\n"
+	}
+	// write a temp file and rename it, so a running proxy never reads half a file
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(data); err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), file); err != nil {
+		return
+	}
+	if del {
+		fmt.Fprintf(os.Stderr, "deleting password for user %s\n", user)
+	} else if found == -1 {
+		fmt.Fprintf(os.Stderr, "adding password for user %s\n", user)
+	} else {
+		fmt.Fprintf(os.Stderr, "updating password for user %s\n", user)
+	}
+	return
+}
+
+func readNewPassword() (pass string, err error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		pass, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if pass = strings.TrimRight(pass, "\r\n"); pass != "" {
+			err = nil
+		}
+		if err != nil {
+			err = fmt.Errorf("read password from stdin fail, err: %s", err)
+		}
+		return
+	}
+	fmt.Fprint(os.Stderr, "New password: ")
+	p1, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return
+	}
+	fmt.Fprint(os.Stderr, "Re-type new password: ")
+	p2, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(p1, p2) {
+		return "", fmt.Errorf("password verification error")
+	}
+	if len(p1) == 0 {
+		return "", fmt.Errorf("empty password")
+	}
+	return string(p1), nil
+}
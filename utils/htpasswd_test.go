@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	tests := []struct {
+		stored string
+		pass   string
+	}{
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA", "Hello world!"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", "password"},
+		{"$2y$05$cPYwU9xZko2u69sWTtBRKuFiY.vPoy/RZHSsIRWo14zQj10y/r8uG", "password"},
+		{"plain", "plain"},
+	}
+	for _, test := range tests {
+		assert.True(t, VerifyPassword(test.stored, test.pass), test.stored)
+		assert.False(t, VerifyPassword(test.stored, test.pass+"x"), test.stored)
+	}
+	for _, algorithm := range []string{HashBcrypt, HashSHA512, HashSHA256, HashSHA1} {
+		stored, err := HashPassword("secret", algorithm, 4)
+		assert.NoError(t, err)
+		assert.True(t, IsPasswordHash(stored))
+		assert.True(t, VerifyPassword(stored, "secret"))
+	}
+}
+
+func TestBasicAuthCheck(t *testing.T) {
+	ba := NewStaticAuth()
+	assert.Equal(t, 2, ba.Add([]string{"a:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "b:p:w", "c:$1$unsupported"}))
+	assert.True(t, ba.Check("a:Hello world!"))
+	assert.True(t, ba.Check("a:Hello world!"))
+	assert.False(t, ba.Check("a:hello"))
+	assert.True(t, ba.Check("b:p:w"))
+	assert.False(t, ba.Check("c:$1$unsupported"))
+	assert.False(t, ba.Check("d:"))
+	// unknown users are checked against a hash of the known ones
+	assert.Equal(t, "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", ba.dummy)
+	assert.False(t, ba.Check("d:Hello world!"))
+}
@@ -0,0 +1,328 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var ErrHTTPHeadTooLarge = errors.New("http head too large")
+
+// readHTTPHead reads a request or response head until the empty line which
+// terminates it, the head may arrive in any number of segments. Empty lines
+// before the start line are skipped but count against maxSize.
+func readHTTPHead(reader *bufio.Reader, maxSize int) (head []byte, err error) {
+	skipped := 0
+	for {
+		var line []byte
+		line, err = reader.ReadSlice('\n')
+		if len(head) == 0 && err == nil && isEmptyLine(line) {
+			if skipped += len(line); skipped > maxSize {
+				return nil, ErrHTTPHeadTooLarge
+			}
+			continue
+		}
+		head = append(head, line...)
+		if len(head) > maxSize {
+			return head, ErrHTTPHeadTooLarge
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(head) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if isEmptyLine(line) {
+			return
+		}
+	}
+}
+
+// WriteHTTPError writes a complete error response, the connection is meant
+// to be closed after it.
+func WriteHTTPError(conn net.Conn, code int, msg string) (err error) {
+	return WriteHTTPResponse(conn, code, nil, msg)
+}
+
+// WriteQuotaError answers a client refused by a Quota, 429 when it is too
+// fast and 503 when it holds too many conns.
+func WriteQuotaError(conn net.Conn, err error) error {
+	code := http.StatusServiceUnavailable
+	if err == ErrQuotaRate {
+		code = http.StatusTooManyRequests
+	}
+	return WriteHTTPResponse(conn, code, []string{"Retry-After: 1"}, err.Error())
+}
+
+// WriteHTTPResponse writes a small response generated by the proxy itself,
+// header lines must not contain the trailing CRLF.
+func WriteHTTPResponse(conn net.Conn, code int, header []string, msg string) (err error) {
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for _, line := range header {
+		buf.WriteString(line + "\r\n")
+	}
+	fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(msg), msg)
+	_, err = conn.Write(buf.Bytes())
+	return
+}
+
+func isEmptyLine(line []byte) bool {
+	return len(line) == 1 && line[0] == '\n' || len(line) == 2 && line[0] == '\r' && line[1] == '\n'
+}
+
+func getHeader(headBuf []byte, key string) (val string, err error) {
+	key = strings.ToUpper(key)
+	lines := strings.Split(string(headBuf), "\r\n")
+	for _, line := range lines {
+		line := strings.SplitN(strings.Trim(line, "\r\n "), ":", 2)
+		if len(line) == 2 {
+			k := strings.ToUpper(strings.Trim(line[0], " "))
+			v := strings.Trim(line[1], " ")
+			if key == k {
+				val = v
+				return
+			}
+		}
+	}
+	err = fmt.Errorf("can not find header: %s", key)
+	return
+}
+
+// hasToken reports whether the comma separated header value contains token.
+func hasToken(val, token string) bool {
+	for _, v := range strings.Split(val, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// isKeepAlive follows RFC 7230 section 6.3: HTTP/1.1 is persistent unless
+// "close" is sent, HTTP/1.0 only if "keep-alive" is sent.
+func isKeepAlive(proto string, headBuf []byte) bool {
+	conn, _ := getHeader(headBuf, connection)
+	if conn == "" {
+		conn, _ = getHeader(headBuf, proxyConnection)
+	}
+	if hasToken(conn, "close") {
+		return false
+	}
+	if proto == "HTTP/1.1" {
+		return true
+	}
+	return hasToken(conn, "keep-alive")
+}
+
+// bodyFraming returns how a message body is delimited, length -1 means the
+// body ends when the connection is closed.
+func bodyFraming(headBuf []byte) (chunked bool, length int64, err error) {
+	if te, e := getHeader(headBuf, TransferEncoding); e == nil && te != "" {
+		return hasToken(te, "chunked"), -1, nil
+	}
+	cl, e := getHeader(headBuf, "Content-Length")
+	if e != nil {
+		return false, -1, nil
+	}
+	length, err = strconv.ParseInt(cl, 10, 64)
+	if err != nil || length < 0 {
+		err = fmt.Errorf("invalid content-length: %s", cl)
+	}
+	return
+}
+
+// BodyFraming returns how the request body is delimited, a request without
+// Content-Length or chunked Transfer-Encoding has no body.
+func (req *HTTPRequest) BodyFraming() (chunked bool, length int64, err error) {
+	chunked, length, err = bodyFraming(req.HeadBuf)
+	if err == nil && !chunked && length < 0 {
+		length = 0
+	}
+	return
+}
+
+// IsKeepAlive reports whether the client wants to keep the connection open
+// after this request, as the head it sent told before its hop-by-hop headers
+// were removed.
+func (req *HTTPRequest) IsKeepAlive() bool {
+	return req.keepAlive
+}
+
+type HTTPResponse struct {
+	HeadBuf    []byte
+	Proto      string
+	StatusCode int
+}
+
+func ReadHTTPResponse(reader *bufio.Reader, bufSize int) (resp HTTPResponse, err error) {
+	resp.HeadBuf, err = readHTTPHead(reader, bufSize)
+	if err != nil {
+		return
+	}
+	index := bytes.IndexByte(resp.HeadBuf, '\n')
+	var status string
+	fmt.Sscanf(string(resp.HeadBuf[:index]), "%s%s", &resp.Proto, &status)
+	resp.Proto = strings.ToUpper(resp.Proto)
+	resp.StatusCode, err = strconv.Atoi(status)
+	if err != nil || !strings.HasPrefix(resp.Proto, "HTTP/") {
+		err = fmt.Errorf("http response status line err:%s", strings.TrimRight(string(resp.HeadBuf[:index]), "\r\n"))
+	}
+	return
+}
+
+func (resp *HTTPResponse) GetHeader(key string) (val string, err error) {
+	return getHeader(resp.HeadBuf, key)
+}
+
+// BodyFraming returns how the response body to a request with the given
+// method is delimited, see RFC 7230 section 3.3.3.
+func (resp *HTTPResponse) BodyFraming(method string) (chunked bool, length int64, err error) {
+	if method == "HEAD" || resp.StatusCode/100 == 1 || resp.StatusCode == 204 || resp.StatusCode == 304 {
+		return false, 0, nil
+	}
+	return bodyFraming(resp.HeadBuf)
+}
+
+func (resp *HTTPResponse) IsKeepAlive() bool {
+	return isKeepAlive(resp.Proto, resp.HeadBuf)
+}
+
+// RemoveHopByHopHeaders removes the headers which only apply to the conn
+// the response came on, RFC 7230 section 6.1, and tells the client by a
+// Connection header whether the conn to it persists. A 101 response keeps its
+// Connection and Upgrade headers, they switch the protocol of the tunnel.
+func (resp *HTTPResponse) RemoveHopByHopHeaders(persist bool) {
+	for _, name := range hopByHopNames(resp.HeadBuf, resp.StatusCode == 101) {
+		for found := true; found; {
+			resp.HeadBuf, found = delHeader(resp.HeadBuf, name)
+		}
+	}
+	if resp.StatusCode == 101 {
+		return
+	}
+	value := "close"
+	if persist {
+		value = "keep-alive"
+	}
+	end := bytes.LastIndex(resp.HeadBuf, []byte("\r\n\r\n"))
+	if end == -1 {
+		return
+	}
+	resp.HeadBuf = append(resp.HeadBuf[:end:end], []byte("\r\n"+connection+": "+value+"\r\n\r\n")...)
+}
+
+// CopyHTTPBody copies a message body from src to dst as is, chunked bodies
+// keep their chunk framing and trailers.
+func CopyHTTPBody(dst io.Writer, src *bufio.Reader, chunked bool, length int64) (err error) {
+	if chunked {
+		return copyChunked(dst, src)
+	}
+	if length < 0 {
+		_, _, err = ioCopy(dst, src)
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+	_, err = io.CopyN(dst, src, length)
+	return
+}
+
+func copyChunked(dst io.Writer, src *bufio.Reader) (err error) {
+	for {
+		var line []byte
+		line, err = readChunkLine(src)
+		if err != nil {
+			return
+		}
+		if _, err = dst.Write(line); err != nil {
+			return
+		}
+		sizeStr := strings.TrimSpace(strings.SplitN(string(line), ";", 2)[0])
+		var size int64
+		size, err = strconv.ParseInt(sizeStr, 16, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid chunk size: %s", sizeStr)
+		}
+		if size == 0 {
+			for {
+				line, err = readChunkLine(src)
+				if err != nil {
+					return
+				}
+				if _, err = dst.Write(line); err != nil {
+					return
+				}
+				if isEmptyLine(line) {
+					return
+				}
+			}
+		}
+		if _, err = io.CopyN(dst, src, size); err != nil {
+			return
+		}
+		line, err = readChunkLine(src)
+		if err != nil {
+			return
+		}
+		if !isEmptyLine(line) {
+			return fmt.Errorf("malformed chunk ending")
+		}
+		if _, err = dst.Write(line); err != nil {
+			return
+		}
+	}
+}
+
+func readChunkLine(src *bufio.Reader) (line []byte, err error) {
+	line, err = src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = fmt.Errorf("chunk line too long")
+	} else if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// HTTPConnect asks the http proxy at the other end of conn to open a tunnel
+// to address, user and pass are sent as Proxy-Authorization if user is set.
+func HTTPConnect(conn net.Conn, address, user, pass string) (outConn net.Conn, err error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if user != "" {
+		fmt.Fprintf(buf, "%s: Basic %s\r\n", proxyAuthorization, base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	buf.WriteString("\r\n")
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := ReadHTTPResponse(reader, 64*1024)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		index := bytes.IndexByte(resp.HeadBuf, '\n')
+		err = fmt.Errorf("CONNECT %s refused: %s", address, strings.TrimSpace(string(resp.HeadBuf[:index])))
+		return
+	}
+	outConn = conn
+	if reader.Buffered() > 0 {
+		outConn = NewBufferedConn(conn, reader)
+	}
+	return
+}
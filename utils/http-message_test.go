@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHTTPRequestPersistent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte("POST http://a.com/x HTTP/1.1\r\nHost: a.com\r\nContent-Length: 5\r\n\r\nhello"))
+		client.Write([]byte("GET http://b.com:8080/y HTTP/1.0\r\nHost: b.com:8080\r\n\r\n"))
+	}()
+	reader := bufio.NewReader(server)
+
+	req, err := NewHTTPRequest(&server, reader, 4096, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "a.com:80", req.Host)
+	assert.True(t, strings.HasPrefix(string(req.HeadBuf), "POST /x HTTP/1.1\r\n"))
+	assert.True(t, req.IsKeepAlive())
+	chunked, length, err := req.BodyFraming()
+	assert.NoError(t, err)
+	assert.False(t, chunked)
+	body := new(bytes.Buffer)
+	assert.NoError(t, CopyHTTPBody(body, reader, chunked, length))
+	assert.Equal(t, "hello", body.String())
+
+	req, err = NewHTTPRequest(&server, reader, 4096, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "b.com:8080", req.Host)
+	assert.Equal(t, "HTTP/1.0", req.Proto)
+	assert.False(t, req.IsKeepAlive())
+	_, length, _ = req.BodyFraming()
+	assert.Equal(t, int64(0), length)
+}
+
+func TestCopyHTTPBodyChunked(t *testing.T) {
+	raw := "5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: 1\r\n\r\nNEXT"
+	reader := bufio.NewReader(strings.NewReader(raw))
+	body := new(bytes.Buffer)
+	assert.NoError(t, CopyHTTPBody(body, reader, true, -1))
+	assert.Equal(t, strings.TrimSuffix(raw, "NEXT"), body.String())
+	rest, _ := reader.ReadString(0)
+	assert.Equal(t, "NEXT", rest)
+}
+
+func TestReadHTTPResponse(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\nok"))
+	resp, err := ReadHTTPResponse(reader, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, resp.IsKeepAlive())
+	_, length, _ := resp.BodyFraming("GET")
+	assert.Equal(t, int64(2), length)
+	_, length, _ = resp.BodyFraming("HEAD")
+	assert.Equal(t, int64(0), length)
+
+	reader = bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nbody"))
+	resp, err = ReadHTTPResponse(reader, 4096)
+	assert.NoError(t, err)
+	assert.False(t, resp.IsKeepAlive())
+	chunked, length, _ := resp.BodyFraming("GET")
+	assert.False(t, chunked)
+	assert.Equal(t, int64(-1), length)
+}
+
+func TestHTTPResponseRemoveHopByHopHeaders(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\nConnection: X-Trace, keep-alive\r\nKeep-Alive: timeout=5\r\nX-Trace: 1\r\nProxy-Connection: close\r\nContent-Length: 0\r\n\r\n"))
+	resp, err := ReadHTTPResponse(reader, 4096)
+	assert.NoError(t, err)
+	resp.RemoveHopByHopHeaders(false)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", string(resp.HeadBuf))
+
+	reader = bufio.NewReader(strings.NewReader("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nKeep-Alive: timeout=5\r\n\r\n"))
+	resp, err = ReadHTTPResponse(reader, 4096)
+	assert.NoError(t, err)
+	resp.RemoveHopByHopHeaders(true)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n", string(resp.HeadBuf))
+}
+
+func TestReadHTTPHeadLimit(t *testing.T) {
+	reader := bufio.NewReaderSize(strings.NewReader("GET / HTTP/1.1\r\nX: "+strings.Repeat("a", 100)+"\r\n\r\n"), 16)
+	_, err := readHTTPHead(reader, 64)
+	assert.Equal(t, ErrHTTPHeadTooLarge, err)
+
+	reader = bufio.NewReaderSize(strings.NewReader("\r\nGET / HTTP/1.1\r\nX: "+strings.Repeat("a", 100)+"\r\n\r\n"), 16)
+	head, err := readHTTPHead(reader, 4096)
+	assert.NoError(t, err)
+	assert.Equal(t, 123, len(head))
+
+	reader = bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: a"))
+	_, err = readHTTPHead(reader, 4096)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestNewHTTPRequestProxyAuth(t *testing.T) {
+	basicAuth := NewStaticAuth()
+	basicAuth.Add([]string{"user:pass"})
+	tests := []struct {
+		head string
+		ok   bool
+	}{
+		{"CONNECT a.com:443 HTTP/1.1\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\n\r\n", true},
+		{"GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\nProxy-Authorization: basic dXNlcjpwYXNz\r\n\r\n", true},
+		{"CONNECT a.com:443 HTTP/1.1\r\n\r\n", false},
+		{"GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\nAuthorization: Basic dXNlcjpwYXNz\r\n\r\n", false},
+		{"GET http://a.com/ HTTP/1.1\r\nHost: a.com\r\nProxy-Authorization: Basic dXNlcjp3cm9uZw==\r\n\r\n", false},
+	}
+	for _, test := range tests {
+		client, server := net.Pipe()
+		go client.Write([]byte(test.head))
+		reply := make(chan string, 1)
+		if !test.ok {
+			go func() {
+				b, _ := io.ReadAll(client)
+				reply <- string(b)
+			}()
+		}
+		req, err := NewHTTPRequest(&server, bufio.NewReader(server), 4096, true, basicAuth)
+		if test.ok {
+			assert.NoError(t, err)
+			assert.NotContains(t, string(req.HeadBuf), "Proxy-Authorization")
+		} else {
+			assert.Error(t, err)
+			resp := <-reply
+			assert.True(t, strings.HasPrefix(resp, "HTTP/1.1 407 "))
+			assert.Contains(t, resp, "Proxy-Authenticate: Basic realm=\"proxy\"\r\n")
+		}
+		client.Close()
+	}
+}
+
+func TestHTTPRequestProxyHead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET http://a.com:8080/x?y HTTP/1.1\r\nHost: a.com:8080\r\nProxy-Connection: keep-alive\r\n\r\n"))
+	req, err := NewHTTPRequest(&server, bufio.NewReader(server), 4096, false, nil)
+	assert.NoError(t, err)
+	req.RemoveHopByHopHeaders()
+	assert.Equal(t, "GET http://a.com:8080/x?y HTTP/1.1\r\nProxy-Authorization: Basic dXNlcjpwYXNz\r\nHost: a.com:8080\r\n\r\n", string(req.ProxyHead("user", "pass")))
+	assert.Equal(t, "GET http://a.com:8080/x?y HTTP/1.1\r\nHost: a.com:8080\r\n\r\n", string(req.ProxyHead("", "")))
+}
+
+func TestNewHTTPRequestTarget(t *testing.T) {
+	for head, want := range map[string]string{
+		"GET /x HTTP/1.1\r\nHost: a.com\r\nOrigin: http://a.com\r\n\r\n":                "GET /x HTTP/1.1\r\nHost: a.com\r\nOrigin: http://a.com\r\n\r\n",
+		"GET http://a.com/x HTTP/1.1\r\nHost: a.com\r\nReferer: http://a.com/y\r\n\r\n": "GET /x HTTP/1.1\r\nHost: a.com\r\nReferer: http://a.com/y\r\n\r\n",
+		"GET HTTP://u@a.com?q HTTP/1.1\r\nHost: a.com\r\n\r\n":                          "GET /?q HTTP/1.1\r\nHost: a.com\r\n\r\n",
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte(head))
+		req, err := NewHTTPRequest(&server, bufio.NewReader(server), 4096, false, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(req.HeadBuf))
+		client.Close()
+	}
+}
+
+func TestHTTPRequestRemoveHopByHopHeaders(t *testing.T) {
+	for head, want := range map[string]string{
+		"GET /x HTTP/1.0\r\nHost: a.com\r\nConnection: keep-alive, X-Trace\r\nX-Trace: 1\r\nKeep-Alive: timeout=5\r\nTE: trailers\r\nUpgrade: h2c\r\n\r\n": "GET /x HTTP/1.0\r\nHost: a.com\r\n\r\n",
+		"GET /ws HTTP/1.1\r\nHost: a.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nProxy-Connection: keep-alive\r\n\r\n":                 "GET /ws HTTP/1.1\r\nHost: a.com\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\r\n",
+	} {
+		client, server := net.Pipe()
+		go client.Write([]byte(head))
+		req, err := NewHTTPRequest(&server, bufio.NewReader(server), 4096, false, nil)
+		assert.NoError(t, err)
+		req.RemoveHopByHopHeaders()
+		assert.Equal(t, want, string(req.HeadBuf))
+		assert.True(t, req.IsKeepAlive(), "told before the headers were removed")
+		client.Close()
+	}
+}
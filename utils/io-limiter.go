@@ -10,6 +10,10 @@ import (
 
 const burstLimit = 1000 * 1000 * 1000
 
+// minBurst is the smallest burst of limiters made by NewRateLimiter, it is
+// larger than the buffers of ioCopy so that a read never waits twice.
+const minBurst = 64 * 1024
+
 type Reader struct {
 	r       io.Reader
 	limiter *rate.Limiter
@@ -75,6 +79,94 @@ func (s *Reader) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+// NewRateLimiter returns a limiter of bytesPerSec which can be shared by many
+// streams, zero means no limit. Its rate can be changed with SetRateLimit.
+func NewRateLimiter(bytesPerSec float64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, minBurst)
+	SetRateLimit(l, bytesPerSec)
+	return l
+}
+
+// SetRateLimit changes the rate of a limiter made by NewRateLimiter, streams
+// using it follow the new rate at once.
+func SetRateLimit(l *rate.Limiter, bytesPerSec float64) {
+	if bytesPerSec <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	burst := int(bytesPerSec)
+	if burst < minBurst {
+		burst = minBurst
+	}
+	l.SetBurst(burst)
+	l.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Limiters are the limiters which apply to one direction of a stream, such
+// as the limiter of its user and the limiter of its service.
+type Limiters []*rate.Limiter
+
+// Reader returns r limited by all limiters.
+func (ls Limiters) Reader(r io.Reader) io.Reader {
+	if len(ls) == 0 {
+		return r
+	}
+	return &limitedReader{r: r, limiters: ls}
+}
+
+// Writer returns w limited by all limiters.
+func (ls Limiters) Writer(w io.Writer) io.Writer {
+	if len(ls) == 0 {
+		return w
+	}
+	return &limitedWriter{w: w, limiters: ls}
+}
+
+// Wait blocks until n bytes are allowed by all limiters, it is used for
+// datagrams which are not read through Reader.
+func (ls Limiters) Wait(n int) (err error) {
+	for _, l := range ls {
+		for left := n; left > 0; {
+			m := left
+			if b := l.Burst(); l.Limit() != rate.Inf && m > b {
+				m = b
+			}
+			if err = l.WaitN(context.Background(), m); err != nil {
+				return
+			}
+			left -= m
+		}
+	}
+	return
+}
+
+type limitedReader struct {
+	r        io.Reader
+	limiters Limiters
+}
+
+func (s *limitedReader) Read(p []byte) (n int, err error) {
+	n, err = s.r.Read(p)
+	if n > 0 {
+		if e := s.limiters.Wait(n); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+type limitedWriter struct {
+	w        io.Writer
+	limiters Limiters
+}
+
+func (s *limitedWriter) Write(p []byte) (n int, err error) {
+	if err = s.limiters.Wait(len(p)); err != nil {
+		return
+	}
+	return s.w.Write(p)
+}
+
 // SetRateLimit sets rate limit (bytes/sec) to the writer.
 func (s *Writer) SetRateLimit(bytesPerSec float64) {
 	s.limiter = rate.NewLimiter(rate.Limit(bytesPerSec), burstLimit)
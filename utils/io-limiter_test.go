@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitersShared(t *testing.T) {
+	const bytesPerSec = 256 * 1024
+	limiters := Limiters{NewRateLimiter(bytesPerSec)}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(io.Discard, limiters.Reader(bytes.NewReader(make([]byte, bytesPerSec))))
+			assert.NoError(t, err)
+			assert.Equal(t, int64(bytesPerSec), n)
+		}()
+	}
+	wg.Wait()
+	// the first second of the two streams is the burst
+	elapsed := time.Since(start)
+	assert.True(t, elapsed > 900*time.Millisecond, elapsed.String())
+	assert.True(t, elapsed < 3*time.Second, elapsed.String())
+
+	SetRateLimit(limiters[0], 0)
+	assert.NoError(t, limiters.Wait(10*bytesPerSec))
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IPFilter accepts or rejects clients by source ip. A client matching the
+// deny list is rejected, when an allow list is set only clients matching it
+// are accepted. Both lists are files with an ip or CIDR each line, they are
+// reloaded when changed.
+type IPFilter struct {
+	allowFile string
+	denyFile  string
+	lock      sync.RWMutex
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	modTimes  map[string]time.Time
+	rejected  uint64
+	logLock   sync.Mutex
+	logged    map[string]time.Time
+}
+
+// a rejected source ip is logged once per ipFilterLogInterval, at most
+// ipFilterLogMax ips are remembered, so a flood of packets or spoofed sources
+// does not flood the log or the memory.
+const (
+	ipFilterLogInterval = time.Minute
+	ipFilterLogMax      = 4096
+)
+
+// NewIPFilter args:
+// allowFile : allow list file, "" means all ips are allowed
+// denyFile  : deny list file, "" means no ip is denied
+// interval  : check the files for changes every interval seconds, zero means no reload
+func NewIPFilter(allowFile, denyFile string, interval int) (f *IPFilter, err error) {
+	f = &IPFilter{
+		allowFile: allowFile,
+		denyFile:  denyFile,
+		modTimes:  map[string]time.Time{},
+		logged:    map[string]time.Time{},
+	}
+	if err = f.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(interval) * time.Second)
+				if f.isChanged() {
+					if err := f.Reload(); err != nil {
+						log.Printf("reload ip filter fail, keep the old lists, err: %s", err)
+					}
+				}
+			}
+		}()
+	}
+	return
+}
+
+// Reload reads both lists again.
+func (f *IPFilter) Reload() (err error) {
+	var allow, deny []*net.IPNet
+	modTimes := map[string]time.Time{}
+	if f.allowFile != "" {
+		if allow, err = loadIPNets(f.allowFile, modTimes); err != nil {
+			return
+		}
+		if len(allow) == 0 {
+			log.Printf("allow list %s is empty, all clients are rejected", f.allowFile)
+		}
+	}
+	if f.denyFile != "" {
+		if deny, err = loadIPNets(f.denyFile, modTimes); err != nil {
+			return
+		}
+	}
+	f.lock.Lock()
+	f.allow, f.deny, f.modTimes = allow, deny, modTimes
+	f.lock.Unlock()
+	log.Printf("ip filter loaded, allow: %d, deny: %d", len(allow), len(deny))
+	return
+}
+
+func (f *IPFilter) isChanged() bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for _, file := range []string{f.allowFile, f.denyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(f.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadIPNets(file string, modTimes map[string]time.Time) (ipNets []*net.IPNet, err error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	modTimes[file] = info.ModTime()
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ipNet, err := ParseIPNet(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", file, i+1, err)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return
+}
+
+// ParseIPNet parses a CIDR or a single ip.
+func ParseIPNet(s string) (ipNet *net.IPNet, err error) {
+	if strings.Contains(s, "/") {
+		_, ipNet, err = net.ParseCIDR(s)
+		return
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}, nil
+}
+
+// Allowed reports whether ip passes the lists.
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for _, ipNet := range f.deny {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	if f.allowFile == "" {
+		return true
+	}
+	for _, ipNet := range f.allow {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept checks the client addr of a listener on localAddr, a rejected client
+// is counted and logged, see ipFilterLogInterval.
+func (f *IPFilter) Accept(addr, localAddr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		return true
+	}
+	if f.Allowed(ip) {
+		return true
+	}
+	n := atomic.AddUint64(&f.rejected, 1)
+	if f.shouldLog(ip.String()) {
+		log.Printf("rejected %s on %s by ip filter, total rejected: %d", addr, localAddr, n)
+	}
+	return false
+}
+
+func (f *IPFilter) shouldLog(ip string) bool {
+	f.logLock.Lock()
+	defer f.logLock.Unlock()
+	now := time.Now()
+	if last, ok := f.logged[ip]; ok && now.Sub(last) < ipFilterLogInterval {
+		return false
+	}
+	if len(f.logged) >= ipFilterLogMax {
+		for key, last := range f.logged {
+			if now.Sub(last) >= ipFilterLogInterval {
+				delete(f.logged, key)
+			}
+		}
+		if len(f.logged) >= ipFilterLogMax {
+			return false
+		}
+	}
+	f.logged[ip] = now
+	return true
+}
+
+// Rejected returns the number of rejected conns and packets.
+func (f *IPFilter) Rejected() uint64 {
+	return atomic.LoadUint64(&f.rejected)
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIPFilter(t *testing.T) {
+	dir := t.TempDir()
+	allowFile := filepath.Join(dir, "allow")
+	denyFile := filepath.Join(dir, "deny")
+	os.WriteFile(allowFile, []byte("10.0.0.0/8\n# office\n192.168.1.1\n2001:db8::/32\n"), 0600)
+	os.WriteFile(denyFile, []byte("10.0.0.1\n"), 0600)
+	f, err := NewIPFilter(allowFile, denyFile, 0)
+	assert.NoError(t, err)
+	assert.True(t, f.Allowed(net.ParseIP("10.1.2.3")))
+	assert.True(t, f.Allowed(net.ParseIP("192.168.1.1")))
+	assert.True(t, f.Allowed(net.ParseIP("2001:db8::1")))
+	assert.False(t, f.Allowed(net.ParseIP("10.0.0.1")))
+	assert.False(t, f.Allowed(net.ParseIP("192.168.1.2")))
+
+	assert.False(t, f.Accept(&net.TCPAddr{IP: net.ParseIP("8.8.8.8"), Port: 1}, &net.TCPAddr{}))
+	assert.True(t, f.Accept(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}, &net.UDPAddr{}))
+	assert.Equal(t, uint64(1), f.Rejected())
+	assert.False(t, f.shouldLog("8.8.8.8"), "logged once per interval")
+	assert.True(t, f.shouldLog("8.8.4.4"))
+
+	os.WriteFile(denyFile, []byte("10.0.0.0/8\n"), 0600)
+	os.Chtimes(denyFile, time.Now(), time.Now().Add(time.Minute))
+	assert.True(t, f.isChanged())
+	assert.NoError(t, f.Reload())
+	assert.False(t, f.Allowed(net.ParseIP("10.1.2.3")))
+
+	os.WriteFile(denyFile, []byte("not an ip\n"), 0600)
+	assert.Error(t, f.Reload())
+	assert.False(t, f.Allowed(net.ParseIP("10.1.2.3")))
+}
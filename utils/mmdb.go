@@ -0,0 +1,262 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// mmdb reads MaxMind DB files, see
+// https://maxmind.github.io/MaxMind-DB/ for the format. Only lookups are
+// supported, records are decoded into maps, slices, strings and numbers.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	dbType     string
+}
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt maxmind db")
+
+// mmdbMaxDepth limits the nesting of maps and arrays, pointers may make them
+// contain themselves in a corrupt db. Real records nest a few levels.
+const mmdbMaxDepth = 32
+
+func parseMMDB(buf []byte) (db *mmdb, err error) {
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("not a maxmind db, metadata not found")
+	}
+	v, _, err := mmdbDecode(buf[i+len(mmdbMetadataMarker):], 0, 0)
+	if err != nil {
+		return
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	db = &mmdb{
+		nodeCount:  mmdbUint(meta["node_count"]),
+		recordSize: mmdbUint(meta["record_size"]),
+		ipVersion:  mmdbUint(meta["ip_version"]),
+	}
+	db.dbType, _ = meta["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d of maxmind db", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d of maxmind db", db.ipVersion)
+	}
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, errMMDBCorrupt
+	}
+	db.tree, db.data = buf[:treeSize], buf[treeSize+16:i]
+	// ipv4 addresses are stored under ::/96 of ipv6 databases
+	if db.ipVersion == 6 {
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return
+}
+
+// record returns the left, bit is 0, or the right record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	return uint(binary.BigEndian.Uint32(db.tree[node*8+bit*4:]))
+}
+
+// lookup returns the record of ip, nil if ip is in no network of db.
+func (db *mmdb) lookup(ip net.IP) (record interface{}, err error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = db.ipv4Start
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(ip[i/8]>>(7-uint(i%8)))&1)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.data)) {
+		return nil, errMMDBCorrupt
+	}
+	record, _, err = mmdbDecode(db.data, offset, 0)
+	return
+}
+
+// mmdbDecode decodes the field at offset of data, next is the offset of the
+// field after it. depth is the number of maps and arrays the field is in.
+func mmdbDecode(data []byte, offset uint, depth int) (v interface{}, next uint, err error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	read := func(n uint) (b []byte, err error) {
+		if offset+n > uint(len(data)) {
+			return nil, errMMDBCorrupt
+		}
+		b, offset = data[offset:offset+n], offset+n
+		return
+	}
+	b, err := read(1)
+	if err != nil {
+		return
+	}
+	ctrl := b[0]
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		size := uint(ctrl>>3)&3 + 1
+		if b, err = read(size); err != nil {
+			return
+		}
+		pointer := uint(0)
+		if size < 4 {
+			pointer = uint(ctrl & 7)
+		}
+		for _, c := range b {
+			pointer = pointer<<8 | uint(c)
+		}
+		pointer += []uint{0, 2048, 526336, 0}[size-1]
+		// a pointer never points to a pointer, which might loop
+		if pointer >= uint(len(data)) || data[pointer]>>5 == 1 {
+			return nil, 0, errMMDBCorrupt
+		}
+		v, _, err = mmdbDecode(data, pointer, depth)
+		return v, offset, err
+	}
+	if typ == 0 {
+		if b, err = read(1); err != nil {
+			return
+		}
+		typ = 7 + uint(b[0])
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		if b, err = read(size - 28); err != nil {
+			return
+		}
+		extra := uint(0)
+		for _, c := range b {
+			extra = extra<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[size-29] + extra
+	}
+	switch typ {
+	case 2, 4:
+		if b, err = read(size); err != nil {
+			return
+		}
+		if typ == 2 {
+			v = string(b)
+		} else {
+			v = append([]byte(nil), b...)
+		}
+	case 3, 15:
+		if size != 8 && typ == 3 || size != 4 && typ == 15 {
+			return nil, 0, errMMDBCorrupt
+		}
+		if b, err = read(size); err != nil {
+			return
+		}
+		if typ == 3 {
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		} else {
+			v = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+		}
+	case 5, 6, 8, 9, 10:
+		if size > 16 {
+			return nil, 0, errMMDBCorrupt
+		}
+		if b, err = read(size); err != nil {
+			return
+		}
+		if typ == 10 {
+			v = append([]byte(nil), b...)
+			break
+		}
+		n := uint64(0)
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if typ == 8 {
+			v = int64(int32(n))
+		} else {
+			v = n
+		}
+	case 7:
+		m := make(map[string]interface{}, size%1024)
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = mmdbDecode(data, offset, depth+1); err != nil {
+				return
+			}
+			if value, offset, err = mmdbDecode(data, offset, depth+1); err != nil {
+				return
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			m[k] = value
+		}
+		v = m
+	case 11:
+		a := make([]interface{}, 0, size%1024)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			if value, offset, err = mmdbDecode(data, offset, depth+1); err != nil {
+				return
+			}
+			a = append(a, value)
+		}
+		v = a
+	case 14:
+		v = size != 0
+	default:
+		return nil, 0, errMMDBCorrupt
+	}
+	return v, offset, nil
+}
+
+func mmdbUint(v interface{}) uint {
+	if n, ok := v.(uint64); ok {
+		return uint(n)
+	}
+	return 0
+}
+
+// mmdbPath returns the value at path of nested maps of record, nil if there
+// is none.
+func mmdbPath(record interface{}, path ...string) interface{} {
+	for _, key := range path {
+		m, ok := record.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		record = m[key]
+	}
+	return record
+}
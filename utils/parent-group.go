@@ -0,0 +1,350 @@
+package utils
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LBRoundRobin = "round-robin"
+	LBLeastConn  = "least-conn"
+	LBLatency    = "latency"
+	LBHash       = "hash"
+)
+
+// a parent is ejected after so many failures in a row and recovers after so
+// many health checks in a row are passed.
+const (
+	parentEjectFails    = 3
+	parentRecoverChecks = 2
+)
+
+// Parent is one parent of a ParentGroup.
+type Parent struct {
+	Name      string
+	Address   string
+	Weight    int
+	pool      OutPool
+	hasPool   bool
+	active    int
+	current   int
+	latency   time.Duration
+	ejected   bool
+	fails     int
+	successes int
+}
+
+// ParentGroup selects a parent for each conn, by weighted round-robin, the
+// fewest active conns per weight, the lowest latency or a consistent hash of
+// the client. Parents are checked every interval seconds by a tcp dial, a
+// parent failing parentEjectFails times in a row is ejected until it passes
+// the checks again. Ejected parents are only tried when all others fail.
+type ParentGroup struct {
+	parents []*Parent
+	method  string
+	timeout int
+	ring    []parentRingPoint
+	lock    sync.Mutex
+}
+
+type parentRingPoint struct {
+	hash   uint32
+	parent *Parent
+}
+
+// ParseParents parses a comma separated list of "host:port" with an optional
+// "name=" and "#weight", such as "10.0.0.1:8080#3,us=10.0.0.2:8080". Parents
+// may share a name, rules select them by it.
+func ParseParents(s string) (parents []*Parent, err error) {
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		p := &Parent{Address: item, Weight: 1}
+		if i := strings.Index(p.Address, "="); i != -1 {
+			p.Name, p.Address = p.Address[:i], p.Address[i+1:]
+		}
+		if i := strings.LastIndex(p.Address, "#"); i != -1 {
+			weight := p.Address[i+1:]
+			p.Address = p.Address[:i]
+			if p.Weight, err = strconv.Atoi(weight); err != nil || p.Weight < 1 {
+				return nil, fmt.Errorf("invalid weight of parent %s", item)
+			}
+		}
+		if _, _, err = net.SplitHostPort(p.Address); err != nil {
+			return nil, fmt.Errorf("invalid parent %s, %s", item, err)
+		}
+		parents = append(parents, p)
+	}
+	if len(parents) == 0 {
+		return nil, fmt.Errorf("no parent in %q", s)
+	}
+	return
+}
+
+// NewParentGroup args:
+// parents  : see ParseParents
+// method   : round-robin, least-conn, latency or hash
+// interval : health check every interval seconds, zero means no check
+// timeout  : dial timeout milliseconds of health checks
+// newPool  : creates the conn pool of a parent, nil for udp parents which are only selected
+func NewParentGroup(parents, method string, interval, timeout int, newPool func(address string) OutPool) (g *ParentGroup, err error) {
+	g = &ParentGroup{method: method, timeout: timeout}
+	if g.parents, err = ParseParents(parents); err != nil {
+		return nil, err
+	}
+	for _, p := range g.parents {
+		if newPool != nil {
+			p.pool = newPool(p.Address)
+			p.hasPool = true
+		}
+		// about 100 points per weight spread the load of hash evenly
+		for i := 0; i < 100*p.Weight; i++ {
+			h := crc32.ChecksumIEEE([]byte(p.Address + "#" + strconv.Itoa(i)))
+			g.ring = append(g.ring, parentRingPoint{hash: h, parent: p})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+	if interval > 0 && newPool != nil {
+		go func() {
+			for {
+				g.check()
+				time.Sleep(time.Duration(interval) * time.Second)
+			}
+		}()
+	}
+	return
+}
+
+// Len returns the number of parents.
+func (g *ParentGroup) Len() int {
+	return len(g.parents)
+}
+
+// Pick returns the parents to try in order for a conn of key, which is the
+// client ip used by hash.
+func (g *ParentGroup) Pick(key string) (parents []*Parent) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var healthy, ejected []*Parent
+	for _, p := range g.parents {
+		if p.ejected {
+			ejected = append(ejected, p)
+		} else {
+			healthy = append(healthy, p)
+		}
+	}
+	switch g.method {
+	case LBLeastConn:
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return healthy[i].active*healthy[j].Weight < healthy[j].active*healthy[i].Weight
+		})
+	case LBLatency:
+		// parents not measured yet come after the measured ones
+		sort.SliceStable(healthy, func(i, j int) bool {
+			if (healthy[i].latency == 0) != (healthy[j].latency == 0) {
+				return healthy[j].latency == 0
+			}
+			return healthy[i].latency < healthy[j].latency
+		})
+	case LBHash:
+		healthy = g.ringOrder(key, healthy)
+	default:
+		healthy = roundRobin(healthy)
+	}
+	return append(healthy, ejected...)
+}
+
+// roundRobin moves the next parent of smooth weighted round-robin to the
+// front, g.lock must be held.
+func roundRobin(parents []*Parent) []*Parent {
+	if len(parents) < 2 {
+		return parents
+	}
+	total, best := 0, 0
+	for i, p := range parents {
+		p.current += p.Weight
+		total += p.Weight
+		if p.current > parents[best].current {
+			best = i
+		}
+	}
+	parents[best].current -= total
+	return append([]*Parent{parents[best]}, append(parents[:best:best], parents[best+1:]...)...)
+}
+
+// ringOrder orders parents by the ring walked from the hash of key, so a
+// client keeps its parent while it is healthy.
+func (g *ParentGroup) ringOrder(key string, parents []*Parent) (ordered []*Parent) {
+	wanted := map[*Parent]bool{}
+	for _, p := range parents {
+		wanted[p] = true
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= h })
+	for i := 0; i < len(g.ring) && len(ordered) < len(parents); i++ {
+		p := g.ring[(start+i)%len(g.ring)].parent
+		if wanted[p] {
+			ordered = append(ordered, p)
+			delete(wanted, p)
+		}
+	}
+	return
+}
+
+// Get returns a conn from the pool of the first parent in Pick order which
+// works, the conn counts as active until it is closed. handshake, if not nil,
+// asks the parent for the tunnel over the conn and returns it, a parent whose
+// handshake fails is reported and the next one is tried. A parent counts as
+// working only after its handshake.
+func (g *ParentGroup) Get(key string, handshake func(conn net.Conn) (net.Conn, error)) (conn net.Conn, parent *Parent, err error) {
+	return g.get(g.Pick(key), handshake)
+}
+
+// GetNamed is Get among the parents named name.
+func (g *ParentGroup) GetNamed(name, key string, handshake func(conn net.Conn) (net.Conn, error)) (conn net.Conn, parent *Parent, err error) {
+	var named []*Parent
+	for _, p := range g.Pick(key) {
+		if p.Name == name {
+			named = append(named, p)
+		}
+	}
+	if len(named) == 0 {
+		return nil, nil, fmt.Errorf("no parent named %s", name)
+	}
+	return g.get(named, handshake)
+}
+
+func (g *ParentGroup) get(parents []*Parent, handshake func(conn net.Conn) (net.Conn, error)) (conn net.Conn, parent *Parent, err error) {
+	for _, p := range parents {
+		if !p.hasPool {
+			err = fmt.Errorf("parent %s has no conn pool", p.Address)
+			continue
+		}
+		var _conn interface{}
+		if _conn, err = p.pool.Pool.Get(); err != nil {
+			log.Printf("get conn of parent %s fail, try the next, err: %s", p.Address, err)
+			g.Report(p, err)
+			continue
+		}
+		g.lock.Lock()
+		p.active++
+		g.lock.Unlock()
+		conn = NewReleaseConn(_conn.(net.Conn), func() {
+			g.lock.Lock()
+			p.active--
+			g.lock.Unlock()
+		})
+		if handshake != nil {
+			var tunnel net.Conn
+			if tunnel, err = handshake(conn); err != nil {
+				conn.Close()
+				log.Printf("handshake with parent %s fail, try the next, err: %s", p.Address, err)
+				g.Report(p, err)
+				continue
+			}
+			conn = tunnel
+		}
+		g.Report(p, nil)
+		return conn, p, nil
+	}
+	return nil, nil, fmt.Errorf("all parents fail, last err: %s", err)
+}
+
+// SendUDP sends packet to the first udp parent in Pick order for key which
+// takes it, conn is left open for the response. Only dial and write errors
+// count as failures of a parent, a request without response may be fine.
+func (g *ParentGroup) SendUDP(packet []byte, key string, timeout int) (conn *net.UDPConn, err error) {
+	for _, parent := range g.Pick(key) {
+		var dstAddr *net.UDPAddr
+		if dstAddr, err = net.ResolveUDPAddr("udp", parent.Address); err != nil {
+			log.Printf("resolve udp addr %s fail,ERR:%s", parent.Address, err)
+			g.Report(parent, err)
+			continue
+		}
+		clientSrcAddr := &net.UDPAddr{IP: net.IPv4zero, Port: 0}
+		if conn, err = net.DialUDP("udp", clientSrcAddr, dstAddr); err != nil {
+			log.Printf("connect to udp %s fail,ERR:%s", dstAddr.String(), err)
+			g.Report(parent, err)
+			continue
+		}
+		conn.SetDeadline(time.Now().Add(time.Millisecond * time.Duration(timeout)))
+		if _, err = conn.Write(packet); err != nil {
+			log.Printf("send udp packet to %s fail,ERR:%s", dstAddr.String(), err)
+			conn.Close()
+			g.Report(parent, err)
+			continue
+		}
+		g.Report(parent, nil)
+		return
+	}
+	return
+}
+
+// Report records a success, err is nil, or a failure of parent p. An ejected
+// parent which works again recovers at once.
+func (g *ParentGroup) Report(p *Parent, err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if err == nil {
+		p.fails = 0
+		if p.ejected {
+			p.ejected = false
+			log.Printf("parent %s recovered", p.Address)
+		}
+		return
+	}
+	p.successes = 0
+	if p.fails++; p.fails >= parentEjectFails && !p.ejected {
+		p.ejected = true
+		log.Printf("parent %s ejected after %d failures, err: %s", p.Address, p.fails, err)
+		if p.hasPool {
+			go p.pool.Pool.ReleaseAll()
+		}
+	}
+}
+
+// check dials every parent and records the results and latencies.
+func (g *ParentGroup) check() {
+	for _, p := range g.parents {
+		start := time.Now()
+		conn, err := ConnectHost(p.Address, g.timeout)
+		latency := time.Since(start)
+		if err != nil {
+			g.Report(p, err)
+			continue
+		}
+		conn.Close()
+		g.lock.Lock()
+		if p.latency == 0 {
+			p.latency = latency
+		} else {
+			p.latency = (p.latency*7 + latency) / 8
+		}
+		p.fails = 0
+		if p.ejected {
+			if p.successes++; p.successes >= parentRecoverChecks {
+				p.ejected = false
+				log.Printf("parent %s recovered, latency: %s", p.Address, p.latency)
+			}
+		}
+		g.lock.Unlock()
+	}
+}
+
+// ReleaseAll releases the conn pools of all parents.
+func (g *ParentGroup) ReleaseAll() {
+	for _, p := range g.parents {
+		if p.hasPool && p.pool.Pool != nil {
+			p.pool.Pool.ReleaseAll()
+		}
+	}
+}
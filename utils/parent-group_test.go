@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseParents(t *testing.T) {
+	parents, err := ParseParents("10.0.0.1:8080#3, [::1]:8080")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:8080", parents[0].Address)
+	assert.Equal(t, 3, parents[0].Weight)
+	assert.Equal(t, "[::1]:8080", parents[1].Address)
+	assert.Equal(t, 1, parents[1].Weight)
+
+	parents, err = ParseParents("us=10.0.0.1:8080#2")
+	assert.NoError(t, err)
+	assert.Equal(t, "us", parents[0].Name)
+	assert.Equal(t, "10.0.0.1:8080", parents[0].Address)
+	assert.Equal(t, 2, parents[0].Weight)
+
+	_, err = ParseParents("10.0.0.1:8080#0")
+	assert.Error(t, err)
+	_, err = ParseParents("10.0.0.1")
+	assert.Error(t, err)
+	_, err = ParseParents("")
+	assert.Error(t, err)
+}
+
+func TestParentGroupRoundRobin(t *testing.T) {
+	g, err := NewParentGroup("a:1#2,b:1,c:1", LBRoundRobin, 0, 0, nil)
+	assert.NoError(t, err)
+	counts := map[string]int{}
+	for i := 0; i < 40; i++ {
+		parents := g.Pick("")
+		assert.Len(t, parents, 3)
+		counts[parents[0].Address]++
+	}
+	assert.Equal(t, map[string]int{"a:1": 20, "b:1": 10, "c:1": 10}, counts)
+}
+
+func TestParentGroupHashAndEject(t *testing.T) {
+	g, err := NewParentGroup("a:1,b:1,c:1", LBHash, 0, 0, nil)
+	assert.NoError(t, err)
+	first := g.Pick("10.0.0.1")[0]
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, first, g.Pick("10.0.0.1")[0])
+	}
+
+	for i := 0; i < parentEjectFails; i++ {
+		g.Report(first, errors.New("refused"))
+	}
+	parents := g.Pick("10.0.0.1")
+	assert.NotEqual(t, first, parents[0])
+	// an ejected parent is the last resort
+	assert.Equal(t, first, parents[2])
+
+	g.Report(first, nil)
+	assert.Equal(t, first, g.Pick("10.0.0.1")[0])
+}
+
+func TestParentGroupLatency(t *testing.T) {
+	g, err := NewParentGroup("a:1,b:1,c:1", LBLatency, 0, 0, nil)
+	assert.NoError(t, err)
+	g.parents[1].latency = 30 * time.Millisecond
+	g.parents[2].latency = 10 * time.Millisecond
+	var order []string
+	for _, p := range g.Pick("") {
+		order = append(order, p.Address)
+	}
+	assert.Equal(t, []string{"c:1", "b:1", "a:1"}, order)
+}
+
+func TestParentGroupHandshakeFailover(t *testing.T) {
+	var addresses []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer l.Close()
+		addresses = append(addresses, l.Addr().String())
+	}
+	g, err := NewParentGroup(addresses[0]+","+addresses[1], LBLatency, 0, 1000, func(address string) OutPool {
+		return NewOutPool(0, false, nil, nil, address, 1000, 0, 0)
+	})
+	assert.NoError(t, err)
+	bad := g.parents[0]
+	handshake := func(conn net.Conn) (net.Conn, error) {
+		if conn.RemoteAddr().String() == bad.Address {
+			return nil, errors.New("refused")
+		}
+		return conn, nil
+	}
+	for i := 0; i < parentEjectFails; i++ {
+		conn, parent, err := g.Get("", handshake)
+		if assert.NoError(t, err) {
+			assert.Equal(t, addresses[1], parent.Address)
+			conn.Close()
+		}
+	}
+	assert.True(t, bad.ejected)
+	assert.Equal(t, 0, bad.active)
+}
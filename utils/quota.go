@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrQuotaConns = errors.New("too many concurrent connections")
+	ErrQuotaRate  = errors.New("too many new connections per second")
+)
+
+// Quota limits the concurrent conns and the new conns per second of each key,
+// such as a client ip or a user.
+type Quota struct {
+	maxConns int
+	connRate float64
+	lock     sync.Mutex
+	entries  map[string]*quotaEntry
+}
+
+type quotaEntry struct {
+	conns    int
+	limiter  *rate.Limiter
+	rejects  *rate.Limiter
+	lastUsed time.Time
+}
+
+// quotaRejectRate is how many conns per second of a key over its quota are
+// told why they are rejected, see AllowReject.
+const quotaRejectRate = 2
+
+// NewQuota args:
+// maxConns : concurrent conns of a key, zero means no limit
+// connRate : new conns per second of a key, bursts of up to one second are allowed, zero means no limit
+func NewQuota(maxConns int, connRate float64) *Quota {
+	q := &Quota{
+		maxConns: maxConns,
+		connRate: connRate,
+		entries:  map[string]*quotaEntry{},
+	}
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			q.sweep()
+		}
+	}()
+	return q
+}
+
+// Acquire takes a conn of key, release must be called when it is closed.
+func (q *Quota) Acquire(key string) (release func(), err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	e := q.entry(key)
+	if q.maxConns > 0 && e.conns >= q.maxConns {
+		return nil, ErrQuotaConns
+	}
+	if e.limiter != nil && !e.limiter.Allow() {
+		return nil, ErrQuotaRate
+	}
+	e.conns++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			q.lock.Lock()
+			e.conns--
+			e.lastUsed = time.Now()
+			q.lock.Unlock()
+		})
+	}, nil
+}
+
+// Allow takes one event of key for the rate limit only, such as a request on
+// a conn which holds its slot already.
+func (q *Quota) Allow(key string) (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if e := q.entry(key); e.limiter != nil && !e.limiter.Allow() {
+		return ErrQuotaRate
+	}
+	return
+}
+
+// AllowReject reports whether a conn of key which is over the quota may be
+// told so, which keeps it open for a while. Past quotaRejectRate per second
+// conns should be closed at once, so a flood does not hold a goroutine and a
+// socket per conn.
+func (q *Quota) AllowReject(key string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	e := q.entry(key)
+	if e.rejects == nil {
+		e.rejects = rate.NewLimiter(quotaRejectRate, quotaRejectRate)
+	}
+	return e.rejects.Allow()
+}
+
+func (q *Quota) entry(key string) *quotaEntry {
+	e, ok := q.entries[key]
+	if !ok {
+		e = &quotaEntry{}
+		if q.connRate > 0 {
+			burst := int(q.connRate)
+			if burst < 1 {
+				burst = 1
+			}
+			e.limiter = rate.NewLimiter(rate.Limit(q.connRate), burst)
+		}
+		q.entries[key] = e
+	}
+	e.lastUsed = time.Now()
+	return e
+}
+
+// sweep drops keys which are idle long enough to have a full rate bucket.
+func (q *Quota) sweep() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	deadline := time.Now().Add(-time.Minute)
+	for key, e := range q.entries {
+		if e.conns == 0 && e.lastUsed.Before(deadline) {
+			delete(q.entries, key)
+		}
+	}
+}
+
+// RejectOverQuota tells a client of a http or socks listener that it is over
+// a quota and closes conn. A http client gets 429 or 503 after its request
+// head is read, a socks5 client is told that no auth method is acceptable and
+// other clients are closed at once.
+func RejectOverQuota(conn net.Conn, err error) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(conn)
+	version, e := reader.Peek(1)
+	if e != nil {
+		return
+	}
+	switch version[0] {
+	case SOCKS4Version:
+	case SOCKS5Version:
+		header := make([]byte, 2)
+		if _, e = io.ReadFull(reader, header); e == nil {
+			if _, e = reader.Discard(int(header[1])); e == nil {
+				conn.Write([]byte{SOCKS5Version, SOCKS5MethodNoAcceptable})
+			}
+		}
+	default:
+		if _, e = readHTTPHead(reader, 64*1024); e == nil {
+			WriteQuotaError(conn, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaConns(t *testing.T) {
+	q := NewQuota(2, 0)
+	release1, err := q.Acquire("1.1.1.1")
+	assert.NoError(t, err)
+	_, err = q.Acquire("1.1.1.1")
+	assert.NoError(t, err)
+	_, err = q.Acquire("1.1.1.1")
+	assert.Equal(t, ErrQuotaConns, err)
+	_, err = q.Acquire("2.2.2.2")
+	assert.NoError(t, err)
+
+	release1()
+	release1()
+	_, err = q.Acquire("1.1.1.1")
+	assert.NoError(t, err)
+	_, err = q.Acquire("1.1.1.1")
+	assert.Equal(t, ErrQuotaConns, err)
+}
+
+func TestQuotaRate(t *testing.T) {
+	q := NewQuota(0, 2)
+	for i := 0; i < 2; i++ {
+		release, err := q.Acquire("alice")
+		assert.NoError(t, err)
+		release()
+	}
+	_, err := q.Acquire("alice")
+	assert.Equal(t, ErrQuotaRate, err)
+	assert.Equal(t, ErrQuotaRate, q.Allow("alice"))
+	assert.NoError(t, q.Allow("bob"))
+}
+
+func TestQuotaAllowReject(t *testing.T) {
+	q := NewQuota(1, 0)
+	for i := 0; i < quotaRejectRate; i++ {
+		assert.True(t, q.AllowReject("alice"))
+	}
+	assert.False(t, q.AllowReject("alice"))
+	assert.True(t, q.AllowReject("bob"))
+}
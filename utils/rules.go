@@ -0,0 +1,332 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RouteDirect   = "direct"
+	RouteParent   = "parent"
+	RouteOutbound = "outbound"
+	RouteReject   = "reject"
+	// RouteRace is no rule action, it races direct against the parent for
+	// hosts the checker has not classified
+	RouteRace = "race"
+)
+
+// Route is where a conn goes. Name is the parent name of parent, "" means
+// any parent, or the outbound name of outbound.
+type Route struct {
+	Action string
+	Name   string
+	// Line and Rule tell the rule which chose the route, Line is 0 if no
+	// rule did
+	Line int
+	Rule string
+}
+
+func (r Route) String() string {
+	if r.Name == "" {
+		return r.Action
+	}
+	return r.Action + ":" + r.Name
+}
+
+// Rules routes conns by an ordered rules file, one rule each line, "#"
+// starts a comment:
+//
+//	<matcher> [matcher...] <action>
+//
+// A rule matches when all of its matchers do, the first matching rule wins.
+// Matchers are
+//
+//	domain:<host>    the host itself
+//	suffix:<domain>  the domain and its subdomains
+//	keyword:<word>   hosts containing word
+//	regex:<regexp>   hosts matching the regexp
+//	cidr:<ip/net>    destination ips, domains are resolved
+//	port:<ports>     destination ports and ranges, such as 80,443,8000-8100
+//	src:<ip/net>     client ips
+//	user:<name>      the authenticated user
+//	geoip:<country>  destination ips in the ISO country, such as CN
+//	asn:<number>     destination ips in the autonomous system
+//	*                every conn
+//
+// and actions are direct, reject, parent for any parent, parent:<name> for
+// the parents named so in --parent, and outbound:<name> for the local address
+// mapped to name or the local ip name. geoip and asn need a GeoIP set by
+// SetGeoIP, they match nothing without.
+type Rules struct {
+	file    string
+	lock    sync.RWMutex
+	rules   []routeRule
+	modTime time.Time
+	geoIP   *GeoIP
+}
+
+type routeRule struct {
+	line     int
+	text     string
+	matchers []ruleMatcher
+	route    Route
+}
+
+type ruleMatcher struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+	ipNet *net.IPNet
+	ports [][2]int
+	asn   uint
+}
+
+// ruleTarget is the conn matched by rules, its ips are resolved when a rule
+// needs them.
+type ruleTarget struct {
+	host     string
+	port     int
+	src      net.IP
+	user     string
+	geoIP    *GeoIP
+	ips      []net.IP
+	resolved bool
+}
+
+// NewRules args:
+// file     : rules file
+// interval : check the file for changes every interval seconds, zero means no reload
+func NewRules(file string, interval int) (r *Rules, err error) {
+	r = &Rules{file: file}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(interval) * time.Second)
+				if r.isChanged() {
+					if err := r.Reload(); err != nil {
+						log.Printf("reload rules fail, keep the old rules, err: %s", err)
+					}
+				}
+			}
+		}()
+	}
+	return
+}
+
+// SetGeoIP sets the GeoIP used by geoip and asn matchers.
+func (r *Rules) SetGeoIP(g *GeoIP) {
+	r.lock.Lock()
+	r.geoIP = g
+	r.lock.Unlock()
+}
+
+// ParseRules parses the content of a rules file.
+func ParseRules(content string) (r *Rules, err error) {
+	r = &Rules{}
+	r.rules, err = parseRules(content)
+	return
+}
+
+// Reload reads the rules file again.
+func (r *Rules) Reload() (err error) {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return
+	}
+	content, err := ioutil.ReadFile(r.file)
+	if err != nil {
+		return
+	}
+	rules, err := parseRules(string(content))
+	if err != nil {
+		return fmt.Errorf("%s %s", r.file, err)
+	}
+	r.lock.Lock()
+	r.rules, r.modTime = rules, info.ModTime()
+	r.lock.Unlock()
+	log.Printf("rules loaded from %s, rules: %d", r.file, len(rules))
+	return
+}
+
+func (r *Rules) isChanged() bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	info, err := os.Stat(r.file)
+	return err == nil && !info.ModTime().Equal(r.modTime)
+}
+
+func parseRules(content string) (rules []routeRule, err error) {
+	for i, line := range strings.Split(content, "\n") {
+		if index := strings.IndexByte(line, '#'); index != -1 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: want <matcher> [matcher...] <action>", i+1)
+		}
+		rule := routeRule{line: i + 1, text: strings.Join(fields, " ")}
+		if rule.route, err = parseRoute(fields[len(fields)-1]); err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		rule.route.Line, rule.route.Rule = rule.line, rule.text
+		for _, field := range fields[:len(fields)-1] {
+			var m ruleMatcher
+			if m, err = parseRuleMatcher(field); err != nil {
+				return nil, fmt.Errorf("line %d: %s", i+1, err)
+			}
+			rule.matchers = append(rule.matchers, m)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseRoute(s string) (route Route, err error) {
+	route.Action = s
+	if i := strings.IndexByte(s, ':'); i != -1 {
+		route.Action, route.Name = s[:i], s[i+1:]
+	}
+	switch route.Action {
+	case RouteDirect, RouteReject:
+		if route.Name != "" {
+			err = fmt.Errorf("action %s takes no name", route.Action)
+		}
+	case RouteParent:
+	case RouteOutbound:
+		if route.Name == "" {
+			err = fmt.Errorf("action outbound needs a name")
+		}
+	default:
+		err = fmt.Errorf("unknown action %s", s)
+	}
+	return
+}
+
+func parseRuleMatcher(s string) (m ruleMatcher, err error) {
+	if s == "*" {
+		return ruleMatcher{kind: s}, nil
+	}
+	i := strings.IndexByte(s, ':')
+	if i < 1 || i == len(s)-1 {
+		return m, fmt.Errorf("invalid matcher %s, want <kind>:<value>", s)
+	}
+	m.kind, m.value = s[:i], s[i+1:]
+	switch m.kind {
+	case "domain", "suffix", "keyword":
+		m.value = strings.ToLower(strings.TrimSuffix(m.value, "."))
+	case "regex":
+		m.re, err = regexp.Compile(m.value)
+	case "cidr", "src":
+		m.ipNet, err = ParseIPNet(m.value)
+	case "port":
+		m.ports, err = parsePortRanges(m.value)
+	case "geoip":
+		m.value = strings.ToUpper(m.value)
+	case "asn":
+		var asn uint64
+		asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(m.value), "AS"), 10, 32)
+		m.asn = uint(asn)
+	case "user":
+	default:
+		err = fmt.Errorf("unknown matcher %s", m.kind)
+	}
+	return
+}
+
+// Match returns the route of the first rule matching a conn from src by user
+// to address, which is "host:port". user is "" for clients which did not
+// authenticate, ok is false if no rule matches.
+func (r *Rules) Match(address string, src net.IP, user string) (route Route, ok bool) {
+	host, _port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	t := &ruleTarget{host: strings.ToLower(strings.TrimSuffix(host, ".")), src: src, user: user}
+	t.port, _ = strconv.Atoi(_port)
+	// the matchers may resolve the host, Reload must not wait for that
+	r.lock.RLock()
+	rules := r.rules
+	t.geoIP = r.geoIP
+	r.lock.RUnlock()
+	for _, rule := range rules {
+		matched := true
+		for _, m := range rule.matchers {
+			if !m.match(t) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.route, true
+		}
+	}
+	return
+}
+
+// IPs returns the destination ips, domains are resolved so a rule of ips can
+// not be bypassed by name.
+func (t *ruleTarget) IPs() []net.IP {
+	if !t.resolved {
+		if ip := net.ParseIP(t.host); ip != nil {
+			t.ips = []net.IP{ip}
+		} else {
+			t.ips, _ = net.LookupIP(t.host)
+		}
+		t.resolved = true
+	}
+	return t.ips
+}
+
+func (m *ruleMatcher) match(t *ruleTarget) bool {
+	switch m.kind {
+	case "*":
+		return true
+	case "domain":
+		return t.host == m.value
+	case "suffix":
+		return t.host == m.value || strings.HasSuffix(t.host, "."+m.value)
+	case "keyword":
+		return strings.Contains(t.host, m.value)
+	case "regex":
+		return m.re.MatchString(t.host)
+	case "cidr":
+		return containsAnyIP(m.ipNet, t.IPs())
+	case "src":
+		return t.src != nil && m.ipNet.Contains(t.src)
+	case "port":
+		for _, r := range m.ports {
+			if t.port >= r[0] && t.port <= r[1] {
+				return true
+			}
+		}
+		return false
+	case "user":
+		return t.user != "" && t.user == m.value
+	case "geoip", "asn":
+		if t.geoIP == nil {
+			return false
+		}
+		for _, ip := range t.IPs() {
+			country, asn := t.geoIP.Lookup(ip)
+			if m.kind == "geoip" && country == m.value || m.kind == "asn" && asn == m.asn {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	r, err := ParseRules(`
+# ads first
+keyword:ads                    reject
+domain:example.com port:443    parent:us
+suffix:google.com              parent
+regex:^cdn[0-9]+\.             outbound:wan2
+cidr:10.0.0.0/8                direct
+src:192.168.1.0/24 user:alice  parent:eu
+`)
+	assert.NoError(t, err)
+	client := net.ParseIP("192.168.1.5")
+	for _, c := range []struct {
+		address, user, route string
+		line                 int
+	}{
+		{"ads.example.com:443", "", "reject", 3},
+		{"example.com:443", "", "parent:us", 4},
+		{"www.google.com:80", "", "parent", 5},
+		{"google.com:80", "", "parent", 5},
+		{"cdn12.example.net:80", "", "outbound:wan2", 6},
+		{"10.1.2.3:22", "", "direct", 7},
+		{"example.com:80", "alice", "parent:eu", 8},
+	} {
+		route, ok := r.Match(c.address, client, c.user)
+		assert.True(t, ok, c.address)
+		assert.Equal(t, c.route, route.String(), c.address)
+		assert.Equal(t, c.line, route.Line, c.address)
+	}
+	_, ok := r.Match("example.com:80", client, "bob")
+	assert.False(t, ok)
+	_, ok = r.Match("notgoogle.com:80", nil, "alice")
+	assert.False(t, ok)
+
+	for _, content := range []string{
+		"direct",
+		"domain:a.com jump",
+		"domain:a.com outbound",
+		"host:a.com direct",
+		"regex:( direct",
+		"port:0 direct",
+		"cidr:x direct",
+	} {
+		_, err = ParseRules(content)
+		assert.Error(t, err, content)
+	}
+}
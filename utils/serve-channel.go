@@ -13,6 +13,9 @@ type ServerChannel struct {
 	Listener         *net.Listener
 	UDPListener      *net.UDPConn
 	errAcceptHandler func(err error)
+	ipFilter         *IPFilter
+	quota            *Quota
+	quotaReject      func(conn net.Conn, err error)
 }
 
 func NewServerChannel(ip string, port int) ServerChannel {
@@ -27,6 +30,50 @@ func NewServerChannel(ip string, port int) ServerChannel {
 func (sc *ServerChannel) SetErrAcceptHandler(fn func(err error)) {
 	sc.errAcceptHandler = fn
 }
+
+// SetIPFilter drops the conns and packets of clients rejected by f, nil
+// accepts all.
+func (sc *ServerChannel) SetIPFilter(f *IPFilter) {
+	sc.ipFilter = f
+}
+
+// SetQuota limits the conns of each client ip by q, nil means no limit. A conn
+// over the quota is passed to reject which should tell the client and close
+// it, nil closes it at once. Past the rate of Quota.AllowReject conns are
+// closed at once and not logged.
+func (sc *ServerChannel) SetQuota(q *Quota, reject func(conn net.Conn, err error)) {
+	sc.quota = q
+	sc.quotaReject = reject
+}
+
+// admit checks a new conn against the ip filter and the quota, it returns nil
+// when the conn is rejected.
+func (sc *ServerChannel) admit(conn net.Conn) net.Conn {
+	if sc.ipFilter != nil && !sc.ipFilter.Accept(conn.RemoteAddr(), conn.LocalAddr()) {
+		conn.Close()
+		return nil
+	}
+	if sc.quota == nil {
+		return conn
+	}
+	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	release, err := sc.quota.Acquire(ip)
+	if err != nil {
+		// a flood of one ip is closed at once without a word
+		if !sc.quota.AllowReject(ip) {
+			conn.Close()
+			return nil
+		}
+		log.Printf("rejected %s on %s, %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		if sc.quotaReject == nil {
+			conn.Close()
+		} else {
+			go sc.quotaReject(conn, err)
+		}
+		return nil
+	}
+	return NewReleaseConn(conn, release)
+}
 func (sc *ServerChannel) ListenTls(certBytes, keyBytes []byte, fn func(conn net.Conn)) (err error) {
 	sc.Listener, err = ListenTls(sc.ip, sc.port, certBytes, keyBytes)
 	if err == nil {
@@ -40,6 +87,9 @@ func (sc *ServerChannel) ListenTls(certBytes, keyBytes []byte, fn func(conn net.
 				var conn net.Conn
 				conn, err = (*sc.Listener).Accept()
 				if err == nil {
+					if conn = sc.admit(conn); conn == nil {
+						continue
+					}
 					go func() {
 						defer func() {
 							if e := recover(); e != nil {
@@ -74,6 +124,9 @@ func (sc *ServerChannel) ListenTCP(fn func(conn net.Conn)) (err error) {
 				var conn net.Conn
 				conn, err = (*sc.Listener).Accept()
 				if err == nil {
+					if conn = sc.admit(conn); conn == nil {
+						continue
+					}
 					go func() {
 						defer func() {
 							if e := recover(); e != nil {
@@ -106,6 +159,9 @@ func (sc *ServerChannel) ListenUDP(fn func(packet []byte, localAddr, srcAddr *ne
 				var buf = make([]byte, 2048)
 				n, srcAddr, err := (*sc.UDPListener).ReadFromUDP(buf)
 				if err == nil {
+					if sc.ipFilter != nil && !sc.ipFilter.Accept(srcAddr, addr) {
+						continue
+					}
 					packet := buf[0:n]
 					go func() {
 						defer func() {
@@ -0,0 +1,398 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	SOCKS4Version     = uint8(4)
+	SOCKS4RepGranted  = uint8(90)
+	SOCKS4RepRejected = uint8(91)
+
+	SOCKS5Version     = uint8(5)
+	SOCKS5AuthVersion = uint8(1)
+
+	SOCKS5MethodNoAuth       = uint8(0)
+	SOCKS5MethodUserPass     = uint8(2)
+	SOCKS5MethodNoAcceptable = uint8(0xff)
+
+	SOCKS5CmdConnect      = uint8(1)
+	SOCKS5CmdBind         = uint8(2)
+	SOCKS5CmdUDPAssociate = uint8(3)
+	// SOCKS5CmdUDPOverTCP is private to goproxy, after the reply the conn
+	// carries UDPPacket frames, addressed to and from the remote peers. Only
+	// the socks service serves it, socks clients of the http port can not
+	// relay udp at all, so a socks parent must be a socks service.
+	SOCKS5CmdUDPOverTCP = uint8(0x80)
+
+	SOCKS5AtypIPv4   = uint8(1)
+	SOCKS5AtypDomain = uint8(3)
+	SOCKS5AtypIPv6   = uint8(4)
+
+	SOCKS5RepSuccess             = uint8(0)
+	SOCKS5RepGeneralFailure      = uint8(1)
+	SOCKS5RepNotAllowed          = uint8(2)
+	SOCKS5RepNetworkUnreachable  = uint8(3)
+	SOCKS5RepHostUnreachable     = uint8(4)
+	SOCKS5RepConnectionRefused   = uint8(5)
+	SOCKS5RepTTLExpired          = uint8(6)
+	SOCKS5RepCommandNotSupported = uint8(7)
+	SOCKS5RepAddrNotSupported    = uint8(8)
+)
+
+var ErrSOCKSAuthFailed = errors.New("socks auth fail")
+
+type SOCKSRequest struct {
+	conn    *net.Conn
+	reader  *bufio.Reader
+	Version uint8
+	Cmd     uint8
+	Host    string
+	User    string
+}
+
+// NewSOCKS5Request negotiates the auth method, checks username and password
+// with auth (RFC 1929) when it is not nil and reads the request (RFC 1928).
+// The reply is left to the caller, see Reply.
+func NewSOCKS5Request(inConn *net.Conn, reader *bufio.Reader, auth func(user, pass string) bool) (req SOCKSRequest, err error) {
+	req = SOCKSRequest{
+		conn:   inConn,
+		reader: reader,
+	}
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if header[0] != SOCKS5Version {
+		err = fmt.Errorf("socks version %d not supported", header[0])
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(reader, methods); err != nil {
+		return
+	}
+	method := SOCKS5MethodNoAuth
+	if auth != nil {
+		method = SOCKS5MethodUserPass
+	}
+	if bytes.IndexByte(methods, method) == -1 {
+		(*inConn).Write([]byte{SOCKS5Version, SOCKS5MethodNoAcceptable})
+		err = fmt.Errorf("no acceptable socks auth method in %v", methods)
+		return
+	}
+	if _, err = (*inConn).Write([]byte{SOCKS5Version, method}); err != nil {
+		return
+	}
+	if method == SOCKS5MethodUserPass {
+		var user, pass string
+		if user, pass, err = readSOCKS5UserPass(reader); err != nil {
+			return
+		}
+		req.User = user
+		if !auth(user, pass) {
+			(*inConn).Write([]byte{SOCKS5AuthVersion, 1})
+			err = ErrSOCKSAuthFailed
+			return
+		}
+		if _, err = (*inConn).Write([]byte{SOCKS5AuthVersion, 0}); err != nil {
+			return
+		}
+	}
+	head := make([]byte, 3)
+	if _, err = io.ReadFull(reader, head); err != nil {
+		return
+	}
+	if head[0] != SOCKS5Version {
+		err = fmt.Errorf("socks version %d not supported", head[0])
+		return
+	}
+	req.Version = head[0]
+	req.Cmd = head[1]
+	req.Host, err = ReadSOCKS5Addr(reader)
+	if err != nil {
+		req.Reply(SOCKS5RepAddrNotSupported, nil)
+	}
+	return
+}
+
+func readSOCKS5UserPass(reader *bufio.Reader) (user, pass string, err error) {
+	var ver, n uint8
+	if ver, err = reader.ReadByte(); err != nil {
+		return
+	}
+	if ver != SOCKS5AuthVersion {
+		err = fmt.Errorf("socks auth version %d not supported", ver)
+		return
+	}
+	buf := make([]byte, 255)
+	if n, err = reader.ReadByte(); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(reader, buf[:n]); err != nil {
+		return
+	}
+	user = string(buf[:n])
+	if n, err = reader.ReadByte(); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(reader, buf[:n]); err != nil {
+		return
+	}
+	pass = string(buf[:n])
+	return
+}
+
+// NewSOCKS4Request reads a SOCKS4 or SOCKS4a request, the USERID is checked
+// with auth when it is not nil. SOCKS4 has no password, so a server which
+// requires passwords should reject it by auth.
+func NewSOCKS4Request(inConn *net.Conn, reader *bufio.Reader, auth func(user string) bool) (req SOCKSRequest, err error) {
+	req = SOCKSRequest{
+		conn:   inConn,
+		reader: reader,
+	}
+	head := make([]byte, 8)
+	if _, err = io.ReadFull(reader, head); err != nil {
+		return
+	}
+	if head[0] != SOCKS4Version {
+		err = fmt.Errorf("socks version %d not supported", head[0])
+		return
+	}
+	req.Version = head[0]
+	req.Cmd = head[1]
+	port := binary.BigEndian.Uint16(head[2:4])
+	host := net.IP(head[4:8]).String()
+	if req.User, err = readSOCKS4String(reader); err != nil {
+		return
+	}
+	// SOCKS4a, 0.0.0.x with x != 0 means the domain name follows the USERID
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		if host, err = readSOCKS4String(reader); err != nil {
+			return
+		}
+	}
+	req.Host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if auth != nil && !auth(req.User) {
+		req.Reply(SOCKS5RepNotAllowed, nil)
+		err = ErrSOCKSAuthFailed
+	}
+	return
+}
+
+func readSOCKS4String(reader *bufio.Reader) (str string, err error) {
+	str, err = reader.ReadString(0)
+	if err != nil {
+		return
+	}
+	if len(str) > 256 {
+		err = fmt.Errorf("socks4 string too long")
+		return
+	}
+	return str[:len(str)-1], nil
+}
+
+// Reply sends the reply to the request, bindAddr is reported as BND.ADDR and
+// BND.PORT, nil means 0.0.0.0:0. rep is a SOCKS5 reply code, for SOCKS4 any
+// failure is sent as rejected.
+func (req *SOCKSRequest) Reply(rep uint8, bindAddr net.Addr) (err error) {
+	addr := "0.0.0.0:0"
+	if bindAddr != nil {
+		addr = bindAddr.String()
+	}
+	var buf []byte
+	if req.Version == SOCKS4Version {
+		buf = []byte{0, SOCKS4RepGranted, 0, 0, 0, 0, 0, 0}
+		if rep != SOCKS5RepSuccess {
+			buf[1] = SOCKS4RepRejected
+		}
+		if a, ok := bindAddr.(*net.TCPAddr); ok && a.IP.To4() != nil {
+			binary.BigEndian.PutUint16(buf[2:4], uint16(a.Port))
+			copy(buf[4:8], a.IP.To4())
+		}
+	} else {
+		var a []byte
+		if a, err = SOCKS5Addr(addr); err != nil {
+			return
+		}
+		buf = append([]byte{SOCKS5Version, rep, 0}, a...)
+	}
+	_, err = (*req.conn).Write(buf)
+	return
+}
+
+// IsConnect reports whether it is a CONNECT request, which is command 1 in
+// both SOCKS4 and SOCKS5.
+func (req *SOCKSRequest) IsConnect() bool {
+	return req.Cmd == SOCKS5CmdConnect
+}
+
+// ReadSOCKS5Addr reads ATYP, DST.ADDR and DST.PORT, and returns them as
+// host:port.
+func ReadSOCKS5Addr(reader io.Reader) (address string, err error) {
+	atyp := make([]byte, 1)
+	if _, err = io.ReadFull(reader, atyp); err != nil {
+		return
+	}
+	var host string
+	switch atyp[0] {
+	case SOCKS5AtypIPv4, SOCKS5AtypIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == SOCKS5AtypIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err = io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case SOCKS5AtypDomain:
+		n := make([]byte, 1)
+		if _, err = io.ReadFull(reader, n); err != nil {
+			return
+		}
+		domain := make([]byte, n[0])
+		if _, err = io.ReadFull(reader, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		err = fmt.Errorf("socks address type %d not supported", atyp[0])
+		return
+	}
+	var port uint16
+	if err = binary.Read(reader, binary.BigEndian, &port); err != nil {
+		return
+	}
+	address = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	return
+}
+
+// SOCKS5Addr encodes host:port as ATYP, ADDR and PORT, a domain longer than
+// 255 bytes can not be encoded.
+func SOCKS5Addr(address string) (b []byte, err error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	port, _ := strconv.Atoi(portStr)
+	buf := new(bytes.Buffer)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf.WriteByte(SOCKS5AtypIPv4)
+			buf.Write(ip4)
+		} else {
+			buf.WriteByte(SOCKS5AtypIPv6)
+			buf.Write(ip.To16())
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("socks5 host too long: %d bytes", len(host))
+		}
+		buf.WriteByte(SOCKS5AtypDomain)
+		buf.WriteByte(uint8(len(host)))
+		buf.WriteString(host)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(port))
+	return buf.Bytes(), nil
+}
+
+// SOCKS5Connect asks the SOCKS5 server at the other end of conn to connect
+// to address, user and pass are only sent if the server asks for them.
+func SOCKS5Connect(conn net.Conn, address, user, pass string) (err error) {
+	_, err = SOCKS5Handshake(conn, SOCKS5CmdConnect, address, user, pass)
+	return
+}
+
+// SOCKS5Handshake sends a request with cmd to the SOCKS5 server at the other
+// end of conn and returns BND.ADDR and BND.PORT of its reply.
+func SOCKS5Handshake(conn net.Conn, cmd uint8, address, user, pass string) (bindAddr string, err error) {
+	methods := []byte{SOCKS5Version, 1, SOCKS5MethodNoAuth}
+	if user != "" {
+		methods = []byte{SOCKS5Version, 2, SOCKS5MethodNoAuth, SOCKS5MethodUserPass}
+	}
+	if _, err = conn.Write(methods); err != nil {
+		return
+	}
+	resp := make([]byte, 2)
+	if _, err = io.ReadFull(conn, resp); err != nil {
+		return
+	}
+	switch resp[1] {
+	case SOCKS5MethodNoAuth:
+	case SOCKS5MethodUserPass:
+		if len(user) > 255 || len(pass) > 255 {
+			err = fmt.Errorf("socks5 username or password too long")
+			return
+		}
+		buf := []byte{SOCKS5AuthVersion, uint8(len(user))}
+		buf = append(buf, user...)
+		buf = append(buf, uint8(len(pass)))
+		buf = append(buf, pass...)
+		if _, err = conn.Write(buf); err != nil {
+			return
+		}
+		if _, err = io.ReadFull(conn, resp); err != nil {
+			return
+		}
+		if resp[1] != 0 {
+			err = ErrSOCKSAuthFailed
+			return
+		}
+	default:
+		err = fmt.Errorf("socks server refused auth methods")
+		return
+	}
+	addr, err := SOCKS5Addr(address)
+	if err != nil {
+		return
+	}
+	if _, err = conn.Write(append([]byte{SOCKS5Version, cmd, 0}, addr...)); err != nil {
+		return
+	}
+	head := make([]byte, 3)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return
+	}
+	if bindAddr, err = ReadSOCKS5Addr(conn); err != nil {
+		return
+	}
+	if head[1] != SOCKS5RepSuccess {
+		err = fmt.Errorf("socks server request %d for %s fail, rep: %d", cmd, address, head[1])
+	}
+	return
+}
+
+// SOCKS5UDP wraps data with the UDP request header, see RFC 1928 section 7.
+func SOCKS5UDP(address string, data []byte) (packet []byte, err error) {
+	addr, err := SOCKS5Addr(address)
+	if err != nil {
+		return
+	}
+	packet = append([]byte{0, 0, 0}, addr...)
+	return append(packet, data...), nil
+}
+
+// ParseSOCKS5UDP parses the UDP request header, fragmented datagrams are not
+// supported.
+func ParseSOCKS5UDP(packet []byte) (address string, data []byte, err error) {
+	if len(packet) < 4 {
+		err = fmt.Errorf("socks udp packet too short")
+		return
+	}
+	if packet[2] != 0 {
+		err = fmt.Errorf("socks udp fragment %d not supported", packet[2])
+		return
+	}
+	reader := bytes.NewReader(packet[3:])
+	if address, err = ReadSOCKS5Addr(reader); err != nil {
+		return
+	}
+	data = packet[len(packet)-reader.Len():]
+	return
+}
@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSOCKS5Handshake(t *testing.T) {
+	tests := []struct {
+		address string
+		user    string
+		pass    string
+		authOk  bool
+	}{
+		{"example.com:443", "", "", true},
+		{"1.2.3.4:80", "user", "pass", true},
+		{"[2001:db8::1]:8080", "user", "pass", true},
+		{"example.com:443", "user", "wrong", false},
+	}
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			var auth func(user, pass string) bool
+			if test.user != "" {
+				auth = func(user, pass string) bool {
+					return user == "user" && pass == "pass"
+				}
+			}
+			done := make(chan error, 1)
+			go func() {
+				done <- SOCKS5Connect(client, test.address, test.user, test.pass)
+			}()
+			req, err := NewSOCKS5Request(&server, bufio.NewReader(server), auth)
+			if !test.authOk {
+				assert.Equal(t, ErrSOCKSAuthFailed, err)
+				assert.Equal(t, ErrSOCKSAuthFailed, <-done)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, req.IsConnect())
+			assert.Equal(t, test.address, req.Host)
+			assert.Equal(t, test.user, req.User)
+			assert.NoError(t, req.Reply(SOCKS5RepSuccess, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}))
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestSOCKS5Addr(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:1080", "[::1]:53", "a.example.com:65535"} {
+		b, err := SOCKS5Addr(address)
+		assert.NoError(t, err)
+		addr, err := ReadSOCKS5Addr(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, address, addr)
+	}
+	_, err := SOCKS5Addr(strings.Repeat("a", 256) + ":80")
+	assert.Error(t, err)
+}
+
+func TestSOCKS5UDP(t *testing.T) {
+	packet, err := SOCKS5UDP("example.com:53", []byte("query"))
+	assert.NoError(t, err)
+	address, data, err := ParseSOCKS5UDP(packet)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com:53", address)
+	assert.Equal(t, []byte("query"), data)
+
+	packet, _ = SOCKS5UDP("1.2.3.4:53", []byte("query"))
+	packet[2] = 1
+	_, _, err = ParseSOCKS5UDP(packet)
+	assert.Error(t, err)
+}
+
+func TestSOCKS4Request(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		client.Write([]byte("\x04\x01\x00\x50\x00\x00\x00\x01user\x00example.com\x00"))
+	}()
+	req, err := NewSOCKS4Request(&server, bufio.NewReader(server), nil)
+	assert.NoError(t, err)
+	assert.True(t, req.IsConnect())
+	assert.Equal(t, "example.com:80", req.Host)
+	assert.Equal(t, "user", req.User)
+	go req.Reply(SOCKS5RepSuccess, nil)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(client, reply)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(SOCKS4RepGranted), reply[1])
+}
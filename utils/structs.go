@@ -1,26 +1,53 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Checker struct {
-	data       ConcurrentMap
-	blockedMap ConcurrentMap
-	directMap  ConcurrentMap
-	interval   int64
-	timeout    int
+	data        *checkerLRU
+	blockedMap  *DomainList
+	directMap   *DomainList
+	interval    int64
+	timeout     int
+	stateFile   string
+	stateMaxAge time.Duration
+	stateLock   *sync.Mutex
+	ttl         time.Duration
+	halfLife    time.Duration
+	probes      chan struct{}
+	probing     *sync.Map
+}
+
+// CheckerLimits bound the hosts a Checker learns and checks.
+type CheckerLimits struct {
+	// MaxHosts is the number of hosts kept, the least recently used are
+	// evicted, zero means no limit
+	MaxHosts int
+	// TTL drops hosts not used for so long, zero means never
+	TTL time.Duration
+	// HalfLife halves the counts of a host not checked for so long, so it is
+	// checked again and its route follows changes, zero means no decay
+	HalfLife time.Duration
+	// Probes is the number of checks run at once, zero means no limit
+	Probes int
 }
 type CheckerItem struct {
 	IsHTTPS      bool
@@ -31,131 +58,217 @@ type CheckerItem struct {
 	Data         []byte
 	SuccessCount uint
 	FailCount    uint
+	// Updated is the time of the last check
+	Updated time.Time
+	// DirectRTT and ParentRTT are the connect times of the last race, zero
+	// if that side failed or was not tried
+	DirectRTT time.Duration
+	ParentRTT time.Duration
 }
 
 // NewChecker args:
 // timeout : tcp timeout milliseconds ,connect to host
 // interval: recheck domain interval seconds
-func NewChecker(timeout int, interval int64, blockedFile, directFile string) Checker {
+// blockedFile, directFile : list files or urls, see DomainList
+// refresh : fetch list urls again every refresh seconds
+// cacheDir: directory of the local copies of list urls
+// stateFile : file the learned hosts are saved to every stateInterval seconds and loaded from, "" means not saved
+// stateMaxAge : hosts not checked for so many seconds are dropped from the state
+// limits  : see CheckerLimits
+func NewChecker(timeout int, interval int64, blockedFile, directFile string, refresh int, cacheDir string, stateFile string, stateInterval, stateMaxAge int, limits CheckerLimits) Checker {
 	ch := Checker{
-		data:     NewConcurrentMap(),
-		interval: interval,
-		timeout:  timeout,
-	}
-	ch.blockedMap = ch.loadMap(blockedFile)
-	ch.directMap = ch.loadMap(directFile)
-	if !ch.blockedMap.IsEmpty() {
-		log.Printf("blocked file loaded , domains : %d", ch.blockedMap.Count())
-	}
-	if !ch.directMap.IsEmpty() {
-		log.Printf("direct file loaded , domains : %d", ch.directMap.Count())
+		data:        newCheckerLRU(limits.MaxHosts),
+		interval:    interval,
+		timeout:     timeout,
+		stateFile:   stateFile,
+		stateMaxAge: time.Duration(stateMaxAge) * time.Second,
+		stateLock:   &sync.Mutex{},
+		ttl:         limits.TTL,
+		halfLife:    limits.HalfLife,
+		probing:     &sync.Map{},
+	}
+	if limits.Probes > 0 {
+		ch.probes = make(chan struct{}, limits.Probes)
+	}
+	ch.blockedMap = NewDomainList(blockedFile, refresh, cacheDir)
+	ch.directMap = NewDomainList(directFile, refresh, cacheDir)
+	if n := ch.blockedMap.Len(); n > 0 {
+		log.Printf("blocked file loaded , domains : %d", n)
+	}
+	if n := ch.directMap.Len(); n > 0 {
+		log.Printf("direct file loaded , domains : %d", n)
+	}
+	if stateFile != "" {
+		if n, err := ch.loadState(); err == nil {
+			log.Printf("checker state loaded , hosts : %d", n)
+		} else if !os.IsNotExist(err) {
+			log.Printf("load checker state fail, err: %s", err)
+		}
+		go func() {
+			for {
+				time.Sleep(time.Duration(stateInterval) * time.Second)
+				if err := ch.SaveState(); err != nil {
+					log.Printf("save checker state to %s fail, err: %s", stateFile, err)
+				}
+			}
+		}()
 	}
 	ch.start()
 	return ch
 }
 
-func (c *Checker) loadMap(f string) (dataMap ConcurrentMap) {
-	dataMap = NewConcurrentMap()
-	if PathExists(f) {
-		_contents, err := ioutil.ReadFile(f)
-		if err != nil {
-			log.Printf("load file err:%s", err)
-			return
-		}
-		for _, line := range strings.Split(string(_contents), "\n") {
-			line = strings.Trim(line, "\r \t")
-			if line != "" {
-				dataMap.Set(line, true)
-			}
-		}
-	}
-	return
-}
 func (c *Checker) start() {
 	go func() {
 		for {
-			for _, v := range c.data.Items() {
+			if c.ttl > 0 {
+				c.data.Expire(c.ttl)
+			}
+			for _, item := range c.data.Items() {
+				if !c.isNeedCheck(item) {
+					continue
+				}
+				// a host is checked once at a time
+				if _, checking := c.probing.LoadOrStore(item.Host, true); checking {
+					continue
+				}
+				if c.probes != nil {
+					c.probes <- struct{}{}
+				}
 				go func(item CheckerItem) {
-					if c.isNeedCheck(item) {
-						//log.Printf("check %s", item.Domain)
-						var conn net.Conn
-						var err error
-						if item.IsHTTPS {
-							conn, err = ConnectHost(item.Host, c.timeout)
-							if err == nil {
-								conn.SetDeadline(time.Now().Add(time.Millisecond))
-								conn.Close()
-							}
-						} else {
-							err = HTTPGet(item.URL, c.timeout)
+					defer func() {
+						c.probing.Delete(item.Host)
+						if c.probes != nil {
+							<-c.probes
 						}
-						if err != nil {
-							item.FailCount = item.FailCount + 1
-						} else {
-							item.SuccessCount = item.SuccessCount + 1
+					}()
+					//log.Printf("check %s", item.Domain)
+					var conn net.Conn
+					var err error
+					if item.IsHTTPS {
+						conn, err = ConnectHost(item.Host, c.timeout)
+						if err == nil {
+							conn.SetDeadline(time.Now().Add(time.Millisecond))
+							conn.Close()
 						}
-						c.data.Set(item.Host, item)
+					} else {
+						err = HTTPGet(item.URL, c.timeout)
 					}
-				}(v.(CheckerItem))
+					c.record(item.Host, err)
+				}(item)
 			}
 			time.Sleep(time.Second * time.Duration(c.interval))
 		}
 	}()
 }
+
+// record counts a check of host, err is nil for a success. The counts decay
+// first, see decayed.
+func (c *Checker) record(host string, err error) {
+	c.data.Update(host, func(item CheckerItem, ok bool) (CheckerItem, bool) {
+		if ok {
+			item = c.count(item, err)
+		}
+		return item, ok
+	})
+}
+
+// count returns item with a check counted, a failure also drops a race won
+// by direct.
+func (c *Checker) count(item CheckerItem, err error) CheckerItem {
+	item.SuccessCount, item.FailCount = c.decayed(item)
+	if err != nil {
+		item.FailCount++
+		item.DirectRTT = 0
+	} else {
+		item.SuccessCount++
+	}
+	item.Updated = time.Now()
+	return item
+}
+
+// decayed returns the counts of item halved for every halfLife since it was
+// checked.
+func (c *Checker) decayed(item CheckerItem) (successN, failN uint) {
+	if c.halfLife <= 0 || item.Updated.IsZero() {
+		return item.SuccessCount, item.FailCount
+	}
+	f := math.Pow(0.5, float64(time.Since(item.Updated))/float64(c.halfLife))
+	return uint(math.Round(float64(item.SuccessCount) * f)), uint(math.Round(float64(item.FailCount) * f))
+}
+
+// isNeedCheck reports whether item is not listed and its decayed counts are
+// too few or too close to tell its route.
 func (c *Checker) isNeedCheck(item CheckerItem) bool {
 	var minCount uint = 5
-	if (item.SuccessCount >= minCount && item.SuccessCount > item.FailCount) ||
-		(item.FailCount >= minCount && item.SuccessCount > item.FailCount) ||
-		c.domainIsInMap(item.Host, false) ||
-		c.domainIsInMap(item.Host, true) {
+	successN, failN := c.decayed(item)
+	if listed, _ := c.InList(item.Host); listed ||
+		(successN >= minCount && successN > failN) ||
+		(failN >= minCount && failN > successN) {
 		return false
 	}
 	return true
 }
 func (c *Checker) IsBlocked(address string) (blocked bool, failN, successN uint) {
-	if c.domainIsInMap(address, true) {
-		//log.Printf("%s in blocked ? true", address)
-		return true, 0, 0
-	}
-	if c.domainIsInMap(address, false) {
-		//log.Printf("%s in direct ? true", address)
-		return false, 0, 0
+	if listed, blocked := c.InList(address); listed {
+		return blocked, 0, 0
 	}
 
-	_item, ok := c.data.Get(address)
+	item, ok := c.data.Get(address)
 	if !ok {
 		//log.Printf("%s not in map, blocked true", address)
 		return true, 0, 0
 	}
-	item := _item.(CheckerItem)
+	successN, failN = c.decayed(item)
+	if (item.DirectRTT > 0 || item.ParentRTT > 0) && c.isNeedCheck(item) {
+		// the checks tell nothing yet, take the faster path of the race
+		return item.DirectRTT == 0 || item.ParentRTT > 0 && item.ParentRTT < item.DirectRTT, failN, successN
+	}
+	return failN >= successN, failN, successN
+}
 
-	return item.FailCount >= item.SuccessCount, item.FailCount, item.SuccessCount
+// NeedRace reports whether address was added but is neither listed nor
+// classified by checks nor raced yet, see Raced.
+func (c *Checker) NeedRace(address string) bool {
+	if listed, _ := c.InList(address); listed {
+		return false
+	}
+	item, ok := c.data.Get(address)
+	return ok && item.DirectRTT == 0 && item.ParentRTT == 0 && c.isNeedCheck(item)
 }
-func (c *Checker) domainIsInMap(address string, blockedMap bool) bool {
+
+// Raced records a race to address, directRTT and parentRTT are the connect
+// times, zero for a side which failed or was not tried. The direct side
+// counts as a check, directErr is its error.
+func (c *Checker) Raced(address string, directRTT, parentRTT time.Duration, directErr error) {
+	c.data.Update(address, func(item CheckerItem, ok bool) (CheckerItem, bool) {
+		if ok {
+			item = c.count(item, directErr)
+			item.DirectRTT, item.ParentRTT = directRTT, parentRTT
+		}
+		return item, ok
+	})
+}
+
+// InList reports whether address is in the blocked or the direct list, and
+// in which one. An exception of one list puts address into the other.
+func (c *Checker) InList(address string) (listed, blocked bool) {
 	u, err := url.Parse("http://" + address)
 	if err != nil {
 		log.Printf("blocked check , url parse err:%s", err)
-		return true
+		return true, true
 	}
-	domainSlice := strings.Split(u.Hostname(), ".")
-	if len(domainSlice) > 1 {
-		subSlice := domainSlice[:len(domainSlice)-1]
-		topDomain := strings.Join(domainSlice[len(domainSlice)-1:], ".")
-		checkDomain := topDomain
-		for i := len(subSlice) - 1; i >= 0; i-- {
-			checkDomain = subSlice[i] + "." + checkDomain
-			if !blockedMap && c.directMap.Has(checkDomain) {
-				return true
-			}
-			if blockedMap && c.blockedMap.Has(checkDomain) {
-				return true
-			}
-		}
+	if matched, excepted := c.blockedMap.Match(u.Hostname()); matched || excepted {
+		//log.Printf("%s in blocked ? %v", address, matched)
+		return true, matched
 	}
-	return false
+	if matched, excepted := c.directMap.Match(u.Hostname()); matched || excepted {
+		//log.Printf("%s in direct ? %v", address, matched)
+		return true, excepted
+	}
+	return false, false
 }
 func (c *Checker) Add(address string, isHTTPS bool, method, URL string, data []byte) {
-	if c.domainIsInMap(address, false) || c.domainIsInMap(address, true) {
+	if listed, _ := c.InList(address); listed {
 		return
 	}
 	if !isHTTPS && strings.ToLower(method) != "get" {
@@ -170,59 +283,115 @@ func (c *Checker) Add(address string, isHTTPS bool, method, URL string, data []b
 		Data:    data,
 		IsHTTPS: isHTTPS,
 		Method:  method,
+		Updated: time.Now(),
 	}
-	c.data.SetIfAbsent(item.Host, item)
+	c.data.SetIfAbsent(item)
+}
+
+// Failed counts a request to address which went direct and failed like a
+// failed check, so the next requests go to the parent at once.
+func (c *Checker) Failed(address string, err error) {
+	c.record(address, err)
+}
+
+// StaticAuth checks credentials given with --auth or loaded from a htpasswd
+// file.
+type StaticAuth struct {
+	data     ConcurrentMap
+	verified ConcurrentMap
+	// dummy is a slow hash of the users, unknown users are checked against
+	// it so they take as long as users with a wrong password
+	dummy string
 }
 
-type BasicAuth struct {
-	data ConcurrentMap
+// basicAuthVerified caches the last password which matched a slow hash, so
+// bcrypt is not run for every request of a client.
+type basicAuthVerified struct {
+	stored string
+	sum    [sha256.Size]byte
 }
 
-func NewBasicAuth() BasicAuth {
-	return BasicAuth{
-		data: NewConcurrentMap(),
+func NewStaticAuth() *StaticAuth {
+	return &StaticAuth{
+		data:     NewConcurrentMap(),
+		verified: NewConcurrentMap(),
 	}
 }
-func (ba *BasicAuth) AddFromFile(file string) (n int, err error) {
+
+// AddFromFile loads a htpasswd file, the password of each "username:password"
+// line is a bcrypt, SHA-256/512 crypt or {SHA} hash, or plaintext.
+func (ba *StaticAuth) AddFromFile(file string) (n int, err error) {
 	_content, err := ioutil.ReadFile(file)
 	if err != nil {
 		return
 	}
 	userpassArr := strings.Split(strings.Replace(string(_content), "\r", "", -1), "\n")
 	for _, userpass := range userpassArr {
-		if strings.HasPrefix("#", userpass) {
+		userpass = strings.Trim(userpass, " ")
+		if strings.HasPrefix(userpass, "#") {
 			continue
 		}
-		u := strings.Split(strings.Trim(userpass, " "), ":")
-		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
+		if ba.add(userpass) {
 			n++
 		}
 	}
 	return
 }
 
-func (ba *BasicAuth) Add(userpassArr []string) (n int) {
+func (ba *StaticAuth) Add(userpassArr []string) (n int) {
 	for _, userpass := range userpassArr {
-		u := strings.Split(userpass, ":")
-		if len(u) == 2 {
-			ba.data.Set(u[0], u[1])
+		if ba.add(userpass) {
 			n++
 		}
 	}
 	return
 }
 
-func (ba *BasicAuth) Check(userpass string) (ok bool) {
-	u := strings.Split(strings.Trim(userpass, " "), ":")
-	if len(u) == 2 {
-		if p, _ok := ba.data.Get(u[0]); _ok {
-			return p.(string) == u[1]
+func (ba *StaticAuth) add(userpass string) bool {
+	u := strings.SplitN(userpass, ":", 2)
+	if len(u) != 2 || u[0] == "" {
+		return false
+	}
+	if strings.HasPrefix(u[1], "$") && !IsPasswordHash(u[1]) {
+		log.Printf("unsupported password hash of user %s, skipped", u[0])
+		return false
+	}
+	if ba.dummy == "" && strings.HasPrefix(u[1], "$") {
+		ba.dummy = u[1]
+	}
+	ba.data.Set(u[0], u[1])
+	return true
+}
+
+func (ba *StaticAuth) Check(userpass string) (ok bool) {
+	u := strings.SplitN(strings.Trim(userpass, " "), ":", 2)
+	if len(u) != 2 {
+		return
+	}
+	_stored, ok := ba.data.Get(u[0])
+	if !ok {
+		// as slow as a wrong password, so the time does not tell which
+		// users exist
+		VerifyPassword(ba.dummy, u[1])
+		return false
+	}
+	stored := _stored.(string)
+	if !strings.HasPrefix(stored, "$") {
+		return VerifyPassword(stored, u[1])
+	}
+	sum := sha256.Sum256([]byte(u[1]))
+	if v, found := ba.verified.Get(u[0]); found {
+		v := v.(basicAuthVerified)
+		if v.stored == stored && subtle.ConstantTimeCompare(v.sum[:], sum[:]) == 1 {
+			return true
 		}
 	}
+	if ok = VerifyPassword(stored, u[1]); ok {
+		ba.verified.Set(u[0], basicAuthVerified{stored: stored, sum: sum})
+	}
 	return
 }
-func (ba *BasicAuth) Total() (n int) {
+func (ba *StaticAuth) Total() (n int) {
 	n = ba.data.Count()
 	return
 }
@@ -233,41 +402,52 @@ type HTTPRequest struct {
 	Host        string
 	Method      string
 	URL         string
+	Proto       string
+	User        string
 	hostOrURL   string
 	isBasicAuth bool
-	basicAuth   *BasicAuth
+	basicAuth   BasicAuth
+	keepAlive   bool
 }
 
-func NewHTTPRequest(inConn *net.Conn, bufSize int, isBasicAuth bool, basicAuth *BasicAuth) (req HTTPRequest, err error) {
-	buf := make([]byte, bufSize)
-	len := 0
+// NewHTTPRequest reads one request head from reader, the body (if any) is left
+// in reader for the caller, so the same reader can be used to read the next
+// request on a persistent connection.
+func NewHTTPRequest(inConn *net.Conn, reader *bufio.Reader, bufSize int, isBasicAuth bool, basicAuth BasicAuth) (req HTTPRequest, err error) {
 	req = HTTPRequest{
 		conn: inConn,
 	}
-	len, err = (*inConn).Read(buf[:])
+	req.HeadBuf, err = readHTTPHead(reader, bufSize)
 	if err != nil {
+		if err == ErrHTTPHeadTooLarge {
+			WriteHTTPError(*inConn, 431, "request head exceeds "+strconv.Itoa(bufSize)+" bytes")
+		} else if e, ok := err.(net.Error); ok && e.Timeout() {
+			if len(req.HeadBuf) > 0 {
+				WriteHTTPError(*inConn, 408, "")
+			} else {
+				// idle persistent conn, same as closed by client
+				err = io.EOF
+			}
+		}
 		if err != io.EOF {
 			err = fmt.Errorf("http decoder read err:%s", err)
 		}
 		CloseConn(inConn)
 		return
 	}
-	req.HeadBuf = buf[:len]
 	index := bytes.IndexByte(req.HeadBuf, '\n')
-	if index == -1 {
-		err = fmt.Errorf("http decoder data line err:%s", string(req.HeadBuf))
-		CloseConn(inConn)
-		return
-	}
-	fmt.Sscanf(string(req.HeadBuf[:index]), "%s%s", &req.Method, &req.hostOrURL)
-	if req.Method == "" || req.hostOrURL == "" {
-		err = fmt.Errorf("http decoder data err:%s", strings.TrimRight(string(req.HeadBuf), "\r\n"))
+	fmt.Sscanf(string(req.HeadBuf[:index]), "%s%s%s", &req.Method, &req.hostOrURL, &req.Proto)
+	if req.Method == "" || req.hostOrURL == "" || !strings.HasPrefix(strings.ToUpper(req.Proto), "HTTP/") {
+		err = fmt.Errorf("http decoder data err:%s", strings.TrimRight(string(req.HeadBuf[:index]), "\r\n"))
+		WriteHTTPError(*inConn, 400, "malformed request line")
 		CloseConn(inConn)
 		return
 	}
 	req.Method = strings.ToUpper(req.Method)
+	req.Proto = strings.ToUpper(req.Proto)
 	req.isBasicAuth = isBasicAuth
 	req.basicAuth = basicAuth
+	req.keepAlive = isKeepAlive(req.Proto, req.HeadBuf)
 	log.Printf("%s: %s", req.Method, req.hostOrURL)
 
 	if req.IsHTTPS() {
@@ -287,23 +467,56 @@ func (req *HTTPRequest) HTTP() (err error) {
 	req.URL, err = req.getHTTPURL()
 	if err == nil {
 		var u *url.URL
-		if u, err = url.Parse(req.URL); err != nil {
+		if u, err = url.Parse(req.URL); err != nil || u.Host == "" {
+			if err == nil {
+				err = fmt.Errorf("no host in request url: %s", req.URL)
+			}
+			WriteHTTPError(*req.conn, 400, "invalid request url")
 			return
 		}
 		req.Host = u.Host
 		req.addPortIfNot()
-		var scheme = u.Scheme
-		if strings.HasPrefix(req.URL, "HTTP://") {
-			scheme = "HTTP://"
-		}
-		cut := []byte(scheme + u.Host)
-		if index := bytes.Index(req.HeadBuf, cut); index != -1 {
-			req.HeadBuf = append(req.HeadBuf[:index], req.HeadBuf[index+len(cut):]...)
+		if !strings.HasPrefix(req.hostOrURL, "/") {
+			req.setRequestTarget(originForm(req.hostOrURL))
 		}
+	} else {
+		WriteHTTPError(*req.conn, 400, "missing host header")
 	}
 	return
 }
+
+// originForm returns the path and query of the absolute url, "/" if it has
+// none.
+func originForm(absURL string) string {
+	rest := absURL[strings.Index(absURL, "://")+3:]
+	index := strings.IndexAny(rest, "/?")
+	if index == -1 {
+		return "/"
+	}
+	if rest[index] == '?' {
+		return "/" + rest[index:]
+	}
+	return rest[index:]
+}
+
+// setRequestTarget replaces the request-target of the request line, the
+// headers are left as they are.
+func (req *HTTPRequest) setRequestTarget(target string) {
+	index := bytes.IndexByte(req.HeadBuf, '\n')
+	line := strings.SplitN(string(req.HeadBuf[:index+1]), " ", 3)
+	if len(line) != 3 {
+		return
+	}
+	line[1] = target
+	req.HeadBuf = append([]byte(strings.Join(line, " ")), req.HeadBuf[index+1:]...)
+}
 func (req *HTTPRequest) HTTPS() (err error) {
+	if req.isBasicAuth {
+		err = req.BasicAuth()
+		if err != nil {
+			return
+		}
+	}
 	req.Host = req.hostOrURL
 	req.addPortIfNot()
 	//_, err = fmt.Fprint(*req.conn, "HTTP/1.1 200 Connection established\r\n\r\n")
@@ -313,38 +526,70 @@ func (req *HTTPRequest) HTTPSReply() (err error) {
 	_, err = fmt.Fprint(*req.conn, "HTTP/1.1 200 Connection established\r\n\r\n")
 	return
 }
+
+// ProxyHead returns the head to send to a standard http proxy, the url is
+// made absolute again and user and pass are sent as Proxy-Authorization if
+// user is set. RemoveHopByHopHeaders must be called before.
+func (req *HTTPRequest) ProxyHead(user, pass string) []byte {
+	index := bytes.Index(req.HeadBuf, []byte("\r\n"))
+	if index == -1 {
+		return req.HeadBuf
+	}
+	line := strings.SplitN(string(req.HeadBuf[:index]), " ", 3)
+	if len(line) == 3 && strings.HasPrefix(line[1], "/") {
+		if u, err := url.Parse(req.URL); err == nil {
+			line[1] = u.Scheme + "://" + u.Host + line[1]
+		}
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString(strings.Join(line, " ") + "\r\n")
+	if user != "" {
+		fmt.Fprintf(buf, "%s: Basic %s\r\n", proxyAuthorization, base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+	}
+	buf.Write(req.HeadBuf[index+2:])
+	return buf.Bytes()
+}
 func (req *HTTPRequest) IsHTTPS() bool {
 	return req.Method == "CONNECT"
 }
 
+// BasicAuth checks the Proxy-Authorization header, the client gets 407 with
+// a Basic challenge when it is missing or wrong. The header is removed after
+// the check, so it is never forwarded.
 func (req *HTTPRequest) BasicAuth() (err error) {
-	authorization, err := req.GetHeader("Authorization")
+	authorization, err := req.GetHeader(proxyAuthorization)
 	if err != nil {
-		fmt.Fprint((*req.conn), "HTTP/1.1 401 Unauthorized\r\nWWW-Authenticate: Basic realm=\"\"\r\n\r\nUnauthorized")
-		CloseConn(req.conn)
+		err = fmt.Errorf("proxy authorization required")
+		req.proxyAuthRequired()
 		return
 	}
+	for req.DelHeader(proxyAuthorization) {
+	}
 	basic := strings.Fields(authorization)
-	if len(basic) != 2 {
-		err = fmt.Errorf("authorization data error,ERR:%s", authorization)
-		CloseConn(req.conn)
+	if len(basic) != 2 || !strings.EqualFold(basic[0], "Basic") {
+		err = fmt.Errorf("proxy authorization data error,ERR:%s", authorization)
+		req.proxyAuthRequired()
 		return
 	}
 	user, err := base64.StdEncoding.DecodeString(basic[1])
 	if err != nil {
-		err = fmt.Errorf("authorization data parse error,ERR:%s", err)
-		CloseConn(req.conn)
+		err = fmt.Errorf("proxy authorization data parse error,ERR:%s", err)
+		req.proxyAuthRequired()
 		return
 	}
-	authOk := (*req.basicAuth).Check(string(user))
+	authOk := req.basicAuth.Check(string(user))
 	if !authOk {
-		fmt.Fprint((*req.conn), "HTTP/1.1 401 Unauthorized\r\n\r\nUnauthorized")
-		CloseConn(req.conn)
 		err = fmt.Errorf("basic auth fail")
+		req.proxyAuthRequired()
 		return
 	}
+	req.User = strings.SplitN(string(user), ":", 2)[0]
 	return
 }
+func (req *HTTPRequest) proxyAuthRequired() {
+	WriteHTTPResponse(*req.conn, 407, []string{proxyAuthenticate + ": Basic realm=\"proxy\""}, "")
+	CloseConn(req.conn)
+}
 func (req *HTTPRequest) getHTTPURL() (URL string, err error) {
 	if !strings.HasPrefix(req.hostOrURL, "/") {
 		return req.hostOrURL, nil
@@ -358,36 +603,39 @@ func (req *HTTPRequest) getHTTPURL() (URL string, err error) {
 }
 
 func (req *HTTPRequest) GetHeader(key string) (val string, err error) {
-	key = strings.ToUpper(key)
-	lines := strings.Split(string(req.HeadBuf), "\r\n")
-	for _, line := range lines {
-		line := strings.SplitN(strings.Trim(line, "\r\n "), ":", 2)
-		if len(line) == 2 {
-			k := strings.ToUpper(strings.Trim(line[0], " "))
-			v := strings.Trim(line[1], " ")
-			if key == k {
-				val = v
-				return
-			}
-		}
-	}
-	err = fmt.Errorf("can not find header: %s", key)
+	return getHeader(req.HeadBuf, key)
+}
+
+func (req *HTTPRequest) DelHeader(key string) (found bool) {
+	req.HeadBuf, found = delHeader(req.HeadBuf, key)
 	return
 }
 
-func (req *HTTPRequest) DelHeader(key string) bool {
+// delHeader removes the first header named key from headBuf.
+func delHeader(headBuf []byte, key string) ([]byte, bool) {
 	key = strings.ToUpper(key)
-	lines := strings.Split(string(req.HeadBuf), "\r\n")
+	lines := strings.Split(string(headBuf), "\r\n")
 	for _, line := range lines {
 		kv := strings.SplitN(strings.Trim(line, "\r\n "), ":", 2)
 		if len(kv) == 2 && key == strings.ToUpper(strings.Trim(kv[0], " ")) {
-			before, after, found := bytes.Cut(req.HeadBuf, append([]byte(line), []byte("\r\n")...))
+			before, after, found := bytes.Cut(headBuf, append([]byte(line), []byte("\r\n")...))
 			if found {
-				req.HeadBuf = append(before, after...)
-				return true
+				return append(before, after...), true
 			}
 		}
 	}
+	return headBuf, false
+}
+
+// IsSafe reports whether the method of req is safe, RFC 7231 section 4.2.1.
+// Only such requests are sent again when a reused conn turns out closed, a
+// proxy must not retry requests which may change something, RFC 7230
+// section 6.3.1.
+func (req *HTTPRequest) IsSafe() bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
 	return false
 }
 
@@ -421,12 +669,34 @@ const (
 // https://datatracker.ietf.org/doc/html/rfc9110#section-7.6.1
 var hopByHopHeaders = []string{
 	proxyConnection, proxyAuthenticate, proxyAuthorization,
-	//connection, keepAlive, TE, Trailers, Upgrade,
+	connection, keepAlive, TE, Trailers, Upgrade,
 }
 
+// hopByHopNames returns the names of the hop-by-hop headers of headBuf, with
+// those listed in its Connection header. upgrade keeps the Connection and
+// Upgrade headers, which switch the protocol of the tunnel.
+func hopByHopNames(headBuf []byte, upgrade bool) (names []string) {
+	conn, _ := getHeader(headBuf, connection)
+	for _, name := range append(strings.Split(conn, ","), hopByHopHeaders...) {
+		name = strings.TrimSpace(name)
+		if name == "" || upgrade && (strings.EqualFold(name, connection) || strings.EqualFold(name, Upgrade)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return
+}
+
+// RemoveHopByHopHeaders removes the headers which only apply to the conn the
+// request came on, RFC 7230 section 6.1. A websocket handshake keeps its
+// Connection and Upgrade headers, the tunnel is switched to it.
 func (req *HTTPRequest) RemoveHopByHopHeaders() {
-	for _, header := range hopByHopHeaders {
-		req.DelHeader(header)
+	upgrade, _ := req.GetHeader(Upgrade)
+	conn, _ := req.GetHeader(connection)
+	websocket := hasToken(upgrade, "websocket") && hasToken(conn, Upgrade)
+	for _, name := range hopByHopNames(req.HeadBuf, websocket) {
+		for req.DelHeader(name) {
+		}
 	}
 }
 
@@ -479,7 +749,11 @@ func NewOutPool(dur int, isTLS bool, certBytes, keyBytes []byte, address string,
 	return
 }
 func (op *OutPool) getConn() (conn interface{}, err error) {
-	if op.isTLS {
+	if op.isTLS && op.certBytes == nil {
+		// a standard https proxy, verified by the system roots
+		dialer := &net.Dialer{Timeout: time.Duration(op.timeout) * time.Millisecond}
+		conn, err = tls.DialWithDialer(dialer, "tcp", op.address, &tls.Config{})
+	} else if op.isTLS {
 		var _conn tls.Conn
 		_conn, err = TlsConnectHost(op.address, op.timeout, op.certBytes, op.keyBytes)
 		if err == nil {
@@ -566,3 +840,100 @@ func (m *PBMapping) isPublic(addr string) bool {
 	ip := net.ParseIP(addr)
 	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
 }
+
+// BufferedConn is a net.Conn whose reads go through a bufio.Reader, so bytes
+// already buffered while parsing are not lost when the conn is handed over.
+type BufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func NewBufferedConn(conn net.Conn, reader *bufio.Reader) net.Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &BufferedConn{
+		Conn:   conn,
+		reader: reader,
+	}
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *BufferedConn) Reader() *bufio.Reader {
+	return c.reader
+}
+
+// PeekConn is a net.Conn whose first read is started at once in the
+// background, so a caller can wait for whichever side of a tunnel speaks
+// first. Read returns the bytes of the first read before reading on.
+type PeekConn struct {
+	net.Conn
+	peeked chan struct{}
+	buf    []byte
+	err    error
+}
+
+// NewPeekConn starts the first read of conn, up to size bytes.
+func NewPeekConn(conn net.Conn, size int) *PeekConn {
+	c := &PeekConn{Conn: conn, peeked: make(chan struct{})}
+	go func() {
+		buf := make([]byte, size)
+		n, err := conn.Read(buf)
+		c.buf, c.err = buf[:n], err
+		close(c.peeked)
+	}()
+	return c
+}
+
+// Peeked is closed when the first read is done.
+func (c *PeekConn) Peeked() <-chan struct{} {
+	return c.peeked
+}
+
+// First waits for the first read and returns its result, the bytes are still
+// returned by Read.
+func (c *PeekConn) First() (b []byte, err error) {
+	<-c.peeked
+	return c.buf, c.err
+}
+
+// Take is First, but the bytes are not returned by Read any more.
+func (c *PeekConn) Take() (b []byte, err error) {
+	<-c.peeked
+	b, c.buf = c.buf, nil
+	return b, c.err
+}
+
+func (c *PeekConn) Read(b []byte) (n int, err error) {
+	<-c.peeked
+	if len(c.buf) > 0 {
+		n = copy(b, c.buf)
+		c.buf = c.buf[n:]
+		return
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+// releaseConn calls release once when it is closed.
+type releaseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// NewReleaseConn returns conn which calls release once when it is closed, such
+// as to give back a quota slot.
+func NewReleaseConn(conn net.Conn, release func()) net.Conn {
+	return &releaseConn{Conn: conn, release: release}
+}
+
+func (c *releaseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// UserLimiter holds the upload and download limiters of users, each shared by
+// all conns of its user. Limits are "user:upload:download" values and lines of
+// "user upload download" in a file which is reloaded when changed, rates are
+// bytes per second with an optional K, M or G suffix, zero means no limit. The
+// user "*" sets the limits of users without their own.
+type UserLimiter struct {
+	file     string
+	static   map[string][2]float64
+	lock     sync.Mutex
+	limits   map[string][2]float64
+	limiters map[string][2]*rate.Limiter
+	modTime  time.Time
+}
+
+// NewUserLimiter args:
+// limits   : "user:upload:download" values
+// file     : limit file, "" means none
+// interval : check the file for changes every interval seconds, zero means no reload
+func NewUserLimiter(limits []string, file string, interval int) (l *UserLimiter, err error) {
+	l = &UserLimiter{
+		file:     file,
+		static:   map[string][2]float64{},
+		limits:   map[string][2]float64{},
+		limiters: map[string][2]*rate.Limiter{},
+	}
+	for _, limit := range limits {
+		u := strings.Split(limit, ":")
+		if len(u) != 3 {
+			return nil, fmt.Errorf("invalid user limit %s, want user:upload:download", limit)
+		}
+		if l.static[u[0]], err = parseRates(u[1], u[2]); err != nil {
+			return nil, err
+		}
+	}
+	if err = l.Reload(); err != nil {
+		return nil, err
+	}
+	if file != "" && interval > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(interval) * time.Second)
+				if info, err := os.Stat(file); err == nil && !info.ModTime().Equal(l.loadedModTime()) {
+					if err = l.Reload(); err != nil {
+						log.Printf("reload user limits fail, keep the old limits, err: %s", err)
+					}
+				}
+			}
+		}()
+	}
+	return
+}
+
+// Reload reads the limit file again, the limits of --user-limit take
+// precedence over it.
+func (l *UserLimiter) Reload() (err error) {
+	limits := map[string][2]float64{}
+	var modTime time.Time
+	if l.file != "" {
+		var info os.FileInfo
+		if info, err = os.Stat(l.file); err != nil {
+			return
+		}
+		modTime = info.ModTime()
+		var content []byte
+		if content, err = ioutil.ReadFile(l.file); err != nil {
+			return
+		}
+		for i, line := range strings.Split(string(content), "\n") {
+			if index := strings.IndexByte(line, '#'); index != -1 {
+				line = line[:index]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 3 {
+				return fmt.Errorf("%s line %d: want user upload download", l.file, i+1)
+			}
+			if limits[fields[0]], err = parseRates(fields[1], fields[2]); err != nil {
+				return fmt.Errorf("%s line %d: %s", l.file, i+1, err)
+			}
+		}
+	}
+	for user, limit := range l.static {
+		limits[user] = limit
+	}
+	l.lock.Lock()
+	l.limits = limits
+	l.modTime = modTime
+	for user, limiters := range l.limiters {
+		limit := l.limitOf(user)
+		SetRateLimit(limiters[0], limit[0])
+		SetRateLimit(limiters[1], limit[1])
+	}
+	l.lock.Unlock()
+	log.Printf("user limits loaded, total:%d", len(limits))
+	return
+}
+
+func (l *UserLimiter) loadedModTime() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.modTime
+}
+
+// Get returns the limiters of user, which are shared by all conns of user.
+func (l *UserLimiter) Get(user string) (upload, download *rate.Limiter) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	limiters, ok := l.limiters[user]
+	if !ok {
+		limit := l.limitOf(user)
+		limiters = [2]*rate.Limiter{NewRateLimiter(limit[0]), NewRateLimiter(limit[1])}
+		l.limiters[user] = limiters
+	}
+	return limiters[0], limiters[1]
+}
+
+func (l *UserLimiter) limitOf(user string) [2]float64 {
+	if limit, ok := l.limits[user]; ok {
+		return limit
+	}
+	return l.limits["*"]
+}
+
+func parseRates(upload, download string) (limit [2]float64, err error) {
+	if limit[0], err = ParseRate(upload); err != nil {
+		return
+	}
+	limit[1], err = ParseRate(download)
+	return
+}
+
+// ParseRate parses bytes per second such as "512K" or "10M".
+func ParseRate(s string) (bytesPerSec float64, err error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+	unit := 1.0
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		unit = 1024
+	case "M":
+		unit = 1024 * 1024
+	case "G":
+		unit = 1024 * 1024 * 1024
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	bytesPerSec, err = strconv.ParseFloat(s, 64)
+	if err != nil || bytesPerSec < 0 {
+		return 0, fmt.Errorf("invalid rate %s", s)
+	}
+	return bytesPerSec * unit, nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+func TestUserLimiter(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "limits")
+	os.WriteFile(file, []byte("alice 1M 2M\n* 100K 0 # default\n"), 0600)
+	l, err := NewUserLimiter([]string{"bob:1K:2K"}, file, 0)
+	assert.NoError(t, err)
+
+	up, down := l.Get("alice")
+	up2, down2 := l.Get("alice")
+	assert.True(t, up == up2 && down == down2, "limiters are shared")
+	assert.Equal(t, rate.Limit(1024*1024), up.Limit())
+	assert.Equal(t, rate.Limit(2*1024*1024), down.Limit())
+
+	up, down = l.Get("bob")
+	assert.Equal(t, rate.Limit(1024), up.Limit())
+	assert.Equal(t, minBurst, up.Burst())
+
+	up, down = l.Get("carol")
+	assert.Equal(t, rate.Limit(100*1024), up.Limit())
+	assert.Equal(t, rate.Inf, down.Limit())
+
+	os.WriteFile(file, []byte("carol 0 512\n"), 0600)
+	assert.NoError(t, l.Reload())
+	assert.Equal(t, rate.Inf, up.Limit())
+	assert.Equal(t, rate.Limit(512), down.Limit())
+
+	os.WriteFile(file, []byte("carol 1K 1K\n"), 0600)
+	assert.NoError(t, l.Reload())
+	assert.Equal(t, rate.Limit(1024), up.Limit())
+	up, _ = l.Get("alice")
+	assert.Equal(t, rate.Inf, up.Limit())
+
+	for _, s := range []string{"", "x", "-1", "1T"} {
+		_, err = ParseRate(s)
+		assert.Error(t, err, s)
+	}
+}